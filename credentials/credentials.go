@@ -0,0 +1,134 @@
+package credentials
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	logrus "github.com/Sirupsen/logrus"
+)
+
+// Credentials of a SafariBooksOnline user
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Provider is one source of credentials. A provider may only know a part
+// of the credentials, e.g. a password file has no username. known holds
+// what the providers before it already found.
+type Provider interface {
+	Name() string
+	Credentials(known Credentials) (Credentials, error)
+}
+
+// Resolve walks the providers in order of precedence and takes the username
+// and password from the first provider knowing each of them.
+func Resolve(providers ...Provider) (Credentials, error) {
+	var result Credentials
+	for _, provider := range providers {
+		if result.Username != "" && result.Password != "" {
+			break
+		}
+
+		credentials, err := provider.Credentials(result)
+		if err != nil {
+			return result, err
+		}
+		if result.Username == "" && credentials.Username != "" {
+			logrus.Debug("username from " + provider.Name())
+			result.Username = credentials.Username
+		}
+		if result.Password == "" && credentials.Password != "" {
+			logrus.Debug("password from " + provider.Name())
+			result.Password = credentials.Password
+		}
+	}
+
+	if result.Username == "" || result.Password == "" {
+		return result, errors.New("missing username or password, see --help for the supported credential sources")
+	}
+	return result, nil
+}
+
+// Static returns fixed credentials, e.g. from flags or the config file
+type Static struct {
+	Source   string
+	Username string
+	Password string
+}
+
+func (s Static) Name() string {
+	return s.Source
+}
+
+func (s Static) Credentials(known Credentials) (Credentials, error) {
+	return Credentials{Username: s.Username, Password: s.Password}, nil
+}
+
+// Env reads SAFARI_USERNAME and SAFARI_PASSWORD
+type Env struct{}
+
+func (Env) Name() string {
+	return "environment"
+}
+
+func (Env) Credentials(known Credentials) (Credentials, error) {
+	return Credentials{
+		Username: os.Getenv("SAFARI_USERNAME"),
+		Password: os.Getenv("SAFARI_PASSWORD"),
+	}, nil
+}
+
+// PasswordFile reads the password from the first line of a file
+type PasswordFile struct {
+	Path string
+}
+
+func (p PasswordFile) Name() string {
+	return "password file " + p.Path
+}
+
+func (p PasswordFile) Credentials(known Credentials) (Credentials, error) {
+	if p.Path == "" {
+		return Credentials{}, nil
+	}
+	content, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return Credentials{}, err
+	}
+	return Credentials{Password: firstLine(content)}, nil
+}
+
+// PasswordCommand runs a shell command, e.g. a password manager cli, and
+// takes the first line of its output as password
+type PasswordCommand struct {
+	Command string
+}
+
+func (p PasswordCommand) Name() string {
+	return "password command"
+}
+
+func (p PasswordCommand) Credentials(known Credentials) (Credentials, error) {
+	if p.Command == "" {
+		return Credentials{}, nil
+	}
+	cmd := exec.Command("sh", "-c", p.Command)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return Credentials{}, errors.New("password command failed: " + err.Error())
+	}
+	return Credentials{Password: firstLine(out)}, nil
+}
+
+func firstLine(content []byte) string {
+	if i := bytes.IndexByte(content, '\n'); i >= 0 {
+		content = content[:i]
+	}
+	return strings.TrimRight(string(content), "\r")
+}
@@ -0,0 +1,99 @@
+package credentials
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolvePrecedence(t *testing.T) {
+	result, err := Resolve(
+		Static{Source: "flags", Username: "flag-user"},
+		Static{Source: "env", Username: "env-user", Password: "env-password"},
+		Static{Source: "config", Username: "config-user", Password: "config-password"},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, Credentials{Username: "flag-user", Password: "env-password"}, result)
+}
+
+type failingProvider struct{}
+
+func (failingProvider) Name() string { return "failing" }
+
+func (failingProvider) Credentials(known Credentials) (Credentials, error) {
+	return Credentials{}, errors.New("should not be asked")
+}
+
+func TestResolveStopsWhenComplete(t *testing.T) {
+	result, err := Resolve(Static{Username: "user", Password: "password"}, failingProvider{})
+	assert.NoError(t, err)
+	assert.Equal(t, "user", result.Username)
+
+	_, err = Resolve(Static{Username: "user"}, failingProvider{})
+	assert.Error(t, err)
+}
+
+func TestResolveMissing(t *testing.T) {
+	_, err := Resolve(Static{Username: "user"})
+	assert.Error(t, err)
+}
+
+func TestEnv(t *testing.T) {
+	os.Setenv("SAFARI_USERNAME", "env-user")
+	os.Setenv("SAFARI_PASSWORD", "env-password")
+	defer os.Unsetenv("SAFARI_USERNAME")
+	defer os.Unsetenv("SAFARI_PASSWORD")
+
+	result, err := Env{}.Credentials(Credentials{})
+	assert.NoError(t, err)
+	assert.Equal(t, Credentials{Username: "env-user", Password: "env-password"}, result)
+}
+
+func TestPasswordFileAndCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "password")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("secret\nignored\n"), 0600))
+
+	result, err := PasswordFile{Path: path}.Credentials(Credentials{})
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", result.Password)
+
+	result, err = PasswordCommand{Command: "echo from-command"}.Credentials(Credentials{})
+	assert.NoError(t, err)
+	assert.Equal(t, "from-command", result.Password)
+
+	_, err = PasswordCommand{Command: "exit 3"}.Credentials(Credentials{})
+	assert.Error(t, err)
+}
+
+func TestEncryptedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "credentials.age")
+	stored := Credentials{Username: "user", Password: "password"}
+	assert.NoError(t, writeEncryptedFile(path, stored, "passphrase", 10))
+
+	passphrase := func(value string) func() (string, error) {
+		return func() (string, error) { return value, nil }
+	}
+
+	result, err := EncryptedFile{Path: path, Passphrase: passphrase("passphrase")}.Credentials(Credentials{})
+	assert.NoError(t, err)
+	assert.Equal(t, stored, result)
+
+	_, err = EncryptedFile{Path: path, Passphrase: passphrase("wrong")}.Credentials(Credentials{})
+	assert.Error(t, err)
+
+	result, err = EncryptedFile{Path: filepath.Join(dir, "missing")}.Credentials(Credentials{})
+	assert.NoError(t, err)
+	assert.Equal(t, Credentials{}, result)
+}
@@ -0,0 +1,90 @@
+package credentials
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"filippo.io/age"
+)
+
+// EncryptedFile reads credentials from an age file encrypted with a
+// passphrase. A missing file is not an error, the provider is just empty.
+type EncryptedFile struct {
+	Path string
+	// Passphrase is asked for only when the file exists
+	Passphrase func() (string, error)
+}
+
+func (e EncryptedFile) Name() string {
+	return "credentials file " + e.Path
+}
+
+func (e EncryptedFile) Credentials(known Credentials) (Credentials, error) {
+	var result Credentials
+	if e.Path == "" {
+		return result, nil
+	}
+	content, err := ioutil.ReadFile(e.Path)
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+
+	passphrase, err := e.Passphrase()
+	if err != nil {
+		return result, err
+	}
+	identity, err := age.NewScryptIdentity(passphrase)
+	if err != nil {
+		return result, err
+	}
+	r, err := age.Decrypt(bytes.NewReader(content), identity)
+	if err != nil {
+		return result, err
+	}
+	plain, err := ioutil.ReadAll(r)
+	if err != nil {
+		return result, err
+	}
+
+	err = json.Unmarshal(plain, &result)
+	return result, err
+}
+
+// WriteEncryptedFile stores credentials encrypted with the passphrase
+func WriteEncryptedFile(path string, credentials Credentials, passphrase string) error {
+	return writeEncryptedFile(path, credentials, passphrase, 0)
+}
+
+func writeEncryptedFile(path string, credentials Credentials, passphrase string, workFactor int) error {
+	recipient, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		return err
+	}
+	if workFactor > 0 {
+		recipient.SetWorkFactor(workFactor)
+	}
+
+	plain, err := json.Marshal(credentials)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	w, err := age.Encrypt(&out, recipient)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(plain); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, out.Bytes(), 0600)
+}
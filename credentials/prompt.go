@@ -0,0 +1,63 @@
+package credentials
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// Prompt asks for the missing parts on the terminal, the password is not
+// echoed. It stays silent when stdin is not a terminal.
+type Prompt struct{}
+
+func (Prompt) Name() string {
+	return "prompt"
+}
+
+func (Prompt) Credentials(known Credentials) (Credentials, error) {
+	result := known
+	if !IsInteractive() {
+		return result, nil
+	}
+
+	var err error
+	if result.Username == "" {
+		result.Username, err = PromptLine("Username: ")
+		if err != nil {
+			return result, err
+		}
+	}
+	if result.Password == "" {
+		result.Password, err = PromptSecret("Password: ")
+	}
+	return result, err
+}
+
+// IsInteractive reports whether stdin is a terminal
+func IsInteractive() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// PromptLine reads one line from stdin
+func PromptLine(label string) (string, error) {
+	fmt.Fprint(os.Stderr, label)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// PromptSecret reads one line from the terminal without echoing it
+func PromptSecret(label string) (string, error) {
+	fmt.Fprint(os.Stderr, label)
+	secret, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
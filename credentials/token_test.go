@@ -0,0 +1,36 @@
+package credentials
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".safari.token")
+
+	token, err := ReadToken(path)
+	assert.NoError(t, err)
+	assert.Empty(t, token)
+
+	// a file left world readable is replaced
+	assert.NoError(t, ioutil.WriteFile(path, []byte("old\n"), 0644))
+	assert.NoError(t, WriteToken(path, "abc.def"))
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	token, err = ReadToken(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc.def", token)
+
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
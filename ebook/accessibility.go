@@ -0,0 +1,157 @@
+package ebook
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// AccessibilityProfile adjusts the typography and contrast of a book for a
+// group of readers and describes the result in the accessibility metadata.
+// Empty fields keep the styles of the theme and the publisher.
+type AccessibilityProfile struct {
+	FontFamily    string
+	FontSize      string
+	LineHeight    string
+	LetterSpacing string
+	WordSpacing   string
+	TextAlign     string
+	Foreground    string
+	Background    string
+	Link          string
+	// Features are the schema.org accessibilityFeature values the profile adds
+	Features []string
+	// Summary is the accessibilitySummary of the book
+	Summary string
+}
+
+// accessibilityPresets are the profiles of --accessibility
+var accessibilityPresets = map[string]AccessibilityProfile{
+	"dyslexia": {
+		FontFamily:    `"OpenDyslexic", "Lexend", "Atkinson Hyperlegible", Verdana, Tahoma, sans-serif`,
+		LineHeight:    "1.8",
+		LetterSpacing: "0.05em",
+		WordSpacing:   "0.16em",
+		TextAlign:     "left",
+		Foreground:    "#1a1a1a",
+		Background:    "#fdf6e3",
+		Summary:       "Styled for dyslexic readers: a dyslexia-friendly font stack, wider letter, word and line spacing, left aligned text and a cream background.",
+	},
+	"high-contrast": {
+		FontFamily: `"Atkinson Hyperlegible", Verdana, sans-serif`,
+		LineHeight: "1.6",
+		Foreground: "#000000",
+		Background: "#ffffff",
+		Link:       "#0000cc",
+		Features:   []string{"highContrastDisplay"},
+		Summary:    "Styled for low vision readers: black text on a white background, underlined links and a legible sans-serif font stack.",
+	},
+	"dark-mode": {
+		LineHeight: "1.6",
+		Foreground: "#e8e6e3",
+		Background: "#181a1b",
+		Link:       "#8ab4f8",
+		Summary:    "Styled for reading in the dark: light text on a dark background with underlined links.",
+	},
+}
+
+// accessibilityFeatures are true for every book this package writes
+var accessibilityFeatures = []string{"displayTransformability", "readingOrder", "tableOfContents"}
+
+// AccessibilityPreset returns a profile by name
+func AccessibilityPreset(name string) (AccessibilityProfile, error) {
+	profile, ok := accessibilityPresets[name]
+	if !ok {
+		return profile, errors.New("unknown accessibility profile " + name + ", expected one of " + strings.Join(AccessibilityPresets(), ", "))
+	}
+	return profile, nil
+}
+
+// AccessibilityPresets lists the profile names
+func AccessibilityPresets() []string {
+	var names []string
+	for name := range accessibilityPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetAccessibility applies a profile to the stylesheet and the metadata,
+// nil turns it off
+func (e *Ebook) SetAccessibility(profile *AccessibilityProfile) {
+	e.accessibility = profile
+}
+
+// writeAccessibilityCSS writes the overrides of a profile. They are
+// important so they win over the publisher stylesheet, listings keep a
+// monospace font without extra spacing. The text colour is set on the text
+// elements only, highlighted listings keep the colours of their theme.
+func writeAccessibilityCSS(w io.Writer, profile AccessibilityProfile) error {
+	var rules []string
+	rule := func(selector string, declarations ...string) {
+		var set []string
+		for i := 0; i < len(declarations); i += 2 {
+			if declarations[i+1] != "" {
+				set = append(set, declarations[i]+": "+declarations[i+1]+" !important")
+			}
+		}
+		if len(set) > 0 {
+			rules = append(rules, selector+" {\n    "+strings.Join(set, ";\n    ")+"\n}")
+		}
+	}
+
+	rule("html, body", "background-color", profile.Background, "color", profile.Foreground, "font-size", profile.FontSize)
+	rule("body, body *",
+		"font-family", profile.FontFamily,
+		"line-height", profile.LineHeight,
+		"letter-spacing", profile.LetterSpacing,
+		"word-spacing", profile.WordSpacing)
+	rule("p, li, dd, dt, blockquote, td, th, caption, figcaption, h1, h2, h3, h4, h5, h6", "color", profile.Foreground)
+	rule("p, li, dd, dt, blockquote, td", "text-align", profile.TextAlign)
+	if profile.FontFamily != "" || profile.LetterSpacing != "" || profile.WordSpacing != "" {
+		rule("pre, pre *, code, kbd, samp",
+			"font-family", "monospace",
+			"letter-spacing", "normal",
+			"word-spacing", "normal")
+	}
+	if profile.Link != "" {
+		rule("a, a *", "color", profile.Link, "text-decoration", "underline")
+	}
+
+	_, err := fmt.Fprintf(w, "\n/* accessibility profile */\n%s\n", strings.Join(rules, "\n"))
+	return err
+}
+
+// opfAccessibility is the schema.org accessibility metadata of the package
+type opfAccessibility struct {
+	AccessModes []string
+	Features    []string
+	Summary     string
+}
+
+// accessibilityMetadata describes the book written with the profile, nil
+// without a profile
+func (e *Ebook) accessibilityMetadata() *opfAccessibility {
+	if e.accessibility == nil {
+		return nil
+	}
+	features := append([]string(nil), accessibilityFeatures...)
+	features = append(features, e.accessibility.Features...)
+	for _, chapter := range e.jsonBook.Chapters {
+		if hasProperty(chapter.Properties, "mathml") {
+			features = append(features, "MathML")
+			break
+		}
+	}
+	sort.Strings(features)
+
+	// every book has a cover image
+	return &opfAccessibility{
+		AccessModes: []string{"textual", "visual"},
+		Features:    features,
+		Summary:     e.accessibility.Summary,
+	}
+}
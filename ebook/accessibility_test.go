@@ -0,0 +1,96 @@
+package ebook
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessibilityPreset(t *testing.T) {
+	assert.Equal(t, []string{"dark-mode", "dyslexia", "high-contrast"}, AccessibilityPresets())
+	profile, err := AccessibilityPreset("dyslexia")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.8", profile.LineHeight)
+	_, err = AccessibilityPreset("sepia")
+	assert.Error(t, err)
+}
+
+func TestWriteAccessibilityCSS(t *testing.T) {
+	var out bytes.Buffer
+	assert.NoError(t, writeAccessibilityCSS(&out, AccessibilityProfile{
+		FontFamily:    "Verdana, sans-serif",
+		LetterSpacing: "0.05em",
+		TextAlign:     "left",
+		Background:    "#ffffff",
+	}))
+	assert.Equal(t, `
+/* accessibility profile */
+html, body {
+    background-color: #ffffff !important
+}
+body, body * {
+    font-family: Verdana, sans-serif !important;
+    letter-spacing: 0.05em !important
+}
+p, li, dd, dt, blockquote, td {
+    text-align: left !important
+}
+pre, pre *, code, kbd, samp {
+    font-family: monospace !important;
+    letter-spacing: normal !important;
+    word-spacing: normal !important
+}
+`, out.String())
+}
+
+func TestWriteAccessibilityMetadata(t *testing.T) {
+	profile, err := AccessibilityPreset("high-contrast")
+	assert.NoError(t, err)
+	path := writeTestBook(t, JsonBook{
+		Title:    "Learning Go",
+		Uuid:     "9781449317904",
+		Language: "en",
+		Chapters: []Chapter{{Id: "ch01", Filename: "ch01.html", Order: 1, Title: "One", Content: `<p><math xmlns="http://www.w3.org/1998/Math/MathML"><mi>x</mi></math></p>`}},
+	}, func(e *Ebook) {
+		e.SetAccessibility(&profile)
+	})
+	defer os.RemoveAll(filepath.Dir(path))
+
+	messages, err := Validate(path)
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+
+	opf := readEpubFile(t, path, "OEBPS/content.opf")
+	assert.Contains(t, opf, `<meta property="schema:accessMode">textual</meta>`)
+	assert.Contains(t, opf, `<meta property="schema:accessibilityFeature">highContrastDisplay</meta>`)
+	assert.Contains(t, opf, `<meta property="schema:accessibilityFeature">MathML</meta>`)
+	assert.Contains(t, opf, `<meta property="schema:accessibilitySummary">`+profile.Summary+`</meta>`)
+	assert.Contains(t, readEpubFile(t, path, "OEBPS/style.css"), "color: #000000 !important")
+}
+
+func TestAccessibilityKeepsCodeColors(t *testing.T) {
+	profile, err := AccessibilityPreset("dark-mode")
+	assert.NoError(t, err)
+	path := writeTestBook(t, JsonBook{
+		Title:    "Learning Go",
+		Uuid:     "9781449317904",
+		Language: "en",
+		Chapters: []Chapter{{Id: "ch01", Filename: "ch01.html", Order: 1, Title: "One", Content: `<p>Hello</p><pre data-type="programlisting" data-code-language="go">func main() {}</pre>`}},
+	}, func(e *Ebook) {
+		e.SetCodeOptions(&CodeOptions{Theme: "light"})
+		e.SetAccessibility(&profile)
+	})
+	defer os.RemoveAll(filepath.Dir(path))
+
+	assert.Contains(t, readEpubFile(t, path, "OEBPS/ch01.html"), `class="chroma"`)
+	css := readEpubFile(t, path, "OEBPS/style.css")
+	assert.Contains(t, css, "pre.chroma { color: #000000;")
+	assert.Contains(t, css, "h6 {\n    color: #e8e6e3 !important\n}")
+	// only links get a colour through a universal selector
+	overrides := css[strings.Index(css, "/* accessibility profile */"):]
+	assert.NotRegexp(t, `(body|pre|chroma) \*[^{}]*\{[^}]*\scolor:`, overrides)
+}
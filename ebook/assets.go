@@ -0,0 +1,35 @@
+package ebook
+
+import (
+	"embed"
+	"encoding/xml"
+	"strings"
+	"text/template"
+)
+
+// assets are the templates and stylesheets of the package, bundled so books
+// are written the same from any working directory
+//
+//go:embed opf.tmpl toc.ncx.tmpl style.css themes/*.css
+var assets embed.FS
+
+// templateFuncs are the functions of the package templates
+var templateFuncs = template.FuncMap{
+	"xml": xmlEscape,
+}
+
+// xmlEscape escapes text for the content or an attribute of an element
+func xmlEscape(text string) string {
+	var out strings.Builder
+	xml.EscapeText(&out, []byte(text))
+	return out.String()
+}
+
+// parseAsset parses a bundled template
+func parseAsset(name string) *template.Template {
+	return template.Must(template.New(name).Funcs(templateFuncs).ParseFS(assets, name))
+}
+
+var opfTmpl = parseAsset("opf.tmpl")
+
+var tocTmpl = parseAsset("toc.ncx.tmpl")
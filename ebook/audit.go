@@ -0,0 +1,202 @@
+package ebook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	logrus "github.com/Sirupsen/logrus"
+)
+
+// AuditOptions turn on the accessibility audit of the chapters
+type AuditOptions struct {
+	// Format of the report written next to the book, text or json, empty
+	// writes no report
+	Format string
+	// CaptionAlt uses the figcaption of a figure as alt text of its images
+	// when they have none
+	CaptionAlt bool
+}
+
+// the kinds of AuditIssue
+const (
+	AuditMissingAlt   = "missing-alt"
+	AuditEmptyAlt     = "empty-alt"
+	AuditTableHeaders = "table-headers"
+	AuditHeadingJump  = "heading-jump"
+	AuditMissingLang  = "missing-lang"
+)
+
+// AuditIssue is one accessibility problem of a chapter
+type AuditIssue struct {
+	Chapter string `json:"chapter"`
+	Kind    string `json:"kind"`
+	Detail  string `json:"detail"`
+}
+
+// AuditReport lists the issues of a book
+type AuditReport struct {
+	Title  string `json:"title"`
+	Images int    `json:"images"`
+	Tables int    `json:"tables"`
+	// CaptionAlts counts the images that got their caption as alt text
+	CaptionAlts int          `json:"caption_alts"`
+	Issues      []AuditIssue `json:"issues"`
+}
+
+// AuditFormats lists the report formats
+func AuditFormats() []string {
+	return []string{"text", "json"}
+}
+
+// CheckAuditFormat reports an unknown report format
+func CheckAuditFormat(format string) error {
+	for _, known := range AuditFormats() {
+		if format == known {
+			return nil
+		}
+	}
+	return errors.New("unknown audit format " + format + ", expected " + strings.Join(AuditFormats(), " or "))
+}
+
+// SetAuditOptions turns on the audit, nil turns it off
+func (e *Ebook) SetAuditOptions(options *AuditOptions) {
+	e.auditOptions = options
+}
+
+var figureReg = regexp.MustCompile(`(?is)<figure[\s>].*?</figure>`)
+var figcaptionReg = regexp.MustCompile(`(?is)<figcaption[^>]*>(.*?)</figcaption>`)
+var altAttrReg = regexp.MustCompile(`(?i)\salt="([^"]*)"`)
+var srcAttrReg = regexp.MustCompile(`(?i)\ssrc="([^"]*)"`)
+var presentationReg = regexp.MustCompile(`(?i)\srole="(presentation|none)"`)
+var tableReg = regexp.MustCompile(`(?is)<table[\s>].*?</table>`)
+var tableHeaderReg = regexp.MustCompile(`(?i)<(th|thead)[\s>]`)
+var headingReg = regexp.MustCompile(`(?i)<h([1-6])[\s>]`)
+
+// captionAlt sets the caption of each figure as alt text of its images
+// without one, it returns the number of images changed
+func captionAlt(content string) (string, int) {
+	changed := 0
+	content = figureReg.ReplaceAllStringFunc(content, func(figure string) string {
+		match := figcaptionReg.FindStringSubmatch(figure)
+		if match == nil {
+			return figure
+		}
+		caption := strings.Join(strings.Fields(html.UnescapeString(tagReg.ReplaceAllString(match[1], ""))), " ")
+		if caption == "" {
+			return figure
+		}
+		return imgTagReg.ReplaceAllStringFunc(figure, func(img string) string {
+			alt := altAttrReg.FindStringSubmatch(img)
+			if alt != nil && strings.TrimSpace(alt[1]) != "" {
+				return img
+			}
+			changed++
+			escaped := html.EscapeString(caption)
+			if alt != nil {
+				return strings.Replace(img, alt[0], ` alt="`+escaped+`"`, 1)
+			}
+			return strings.Replace(img, "<img", `<img alt="`+escaped+`"`, 1)
+		})
+	})
+	return content, changed
+}
+
+// auditChapter adds the issues of one chapter to the report
+func (r *AuditReport) auditChapter(chapter Chapter, content string, language string) {
+	add := func(kind string, format string, args ...interface{}) {
+		r.Issues = append(r.Issues, AuditIssue{Chapter: chapter.Filename, Kind: kind, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	if language == "" {
+		add(AuditMissingLang, "the book has no language, the chapter has no lang attribute")
+	}
+
+	for _, img := range imgTagReg.FindAllString(content, -1) {
+		r.Images++
+		if presentationReg.MatchString(img) {
+			continue
+		}
+		src := ""
+		if match := srcAttrReg.FindStringSubmatch(img); match != nil {
+			src = match[1]
+		}
+		alt := altAttrReg.FindStringSubmatch(img)
+		if alt == nil {
+			add(AuditMissingAlt, "image %s has no alt text", src)
+		} else if strings.TrimSpace(alt[1]) == "" {
+			add(AuditEmptyAlt, "image %s has an empty alt text", src)
+		}
+	}
+
+	for index, table := range tableReg.FindAllString(content, -1) {
+		r.Tables++
+		if !tableHeaderReg.MatchString(table) {
+			add(AuditTableHeaders, "table %d has no header cells", index+1)
+		}
+	}
+
+	// the first heading sets the level, sections may start below h1
+	previous := 0
+	for _, match := range headingReg.FindAllStringSubmatch(content, -1) {
+		level, _ := strconv.Atoi(match[1])
+		if previous > 0 && level > previous+1 {
+			add(AuditHeadingJump, "heading h%d follows h%d", level, previous)
+		}
+		previous = level
+	}
+}
+
+// auditPath is the report of a book saved to outputPath
+func auditPath(outputPath string, format string) string {
+	ext := ".txt"
+	if format == "json" {
+		ext = ".json"
+	}
+	return strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".accessibility" + ext
+}
+
+// writeAudit saves the report next to the book
+func (e *Ebook) writeAudit(outputPath string) {
+	path := auditPath(outputPath, e.auditOptions.Format)
+	f, err := os.Create(path)
+	check(err)
+	defer f.Close()
+	if e.auditOptions.Format == "json" {
+		check(WriteAuditJSON(f, e.auditReport))
+	} else {
+		check(WriteAuditText(f, e.auditReport))
+	}
+	logrus.Info(fmt.Sprintf("accessibility audit found %d issues, report saved to %s", len(e.auditReport.Issues), path))
+}
+
+// WriteAuditText writes one issue per line after a summary
+func WriteAuditText(w io.Writer, report AuditReport) error {
+	if _, err := fmt.Fprintf(w, "Accessibility audit of %s\n%d images, %d tables, %d alt texts from captions, %d issues\n",
+		report.Title, report.Images, report.Tables, report.CaptionAlts, len(report.Issues)); err != nil {
+		return err
+	}
+	for _, issue := range report.Issues {
+		if _, err := fmt.Fprintf(w, "%s: %s: %s\n", issue.Chapter, issue.Kind, issue.Detail); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteAuditJSON writes the report as indented json
+func WriteAuditJSON(w io.Writer, report AuditReport) error {
+	if report.Issues == nil {
+		report.Issues = []AuditIssue{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
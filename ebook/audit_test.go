@@ -0,0 +1,77 @@
+package ebook
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditChapter(t *testing.T) {
+	content := `<h1>Pods</h1><img src="images/a.png" /><img src="images/b.png" alt=" " />` +
+		`<img src="images/rule.png" alt="" role="presentation" /><img src="images/c.png" alt="A pod" />` +
+		`<h3>Too deep</h3><table><tr><td>1</td></tr></table><table><thead><tr><th>n</th></tr></thead></table><h2>Back up</h2>`
+
+	report := AuditReport{}
+	report.auditChapter(Chapter{Filename: "ch01.html"}, content, "")
+	assert.Equal(t, 4, report.Images)
+	assert.Equal(t, 2, report.Tables)
+	assert.Equal(t, []AuditIssue{
+		{Chapter: "ch01.html", Kind: AuditMissingLang, Detail: "the book has no language, the chapter has no lang attribute"},
+		{Chapter: "ch01.html", Kind: AuditMissingAlt, Detail: "image images/a.png has no alt text"},
+		{Chapter: "ch01.html", Kind: AuditEmptyAlt, Detail: "image images/b.png has an empty alt text"},
+		{Chapter: "ch01.html", Kind: AuditTableHeaders, Detail: "table 1 has no header cells"},
+		{Chapter: "ch01.html", Kind: AuditHeadingJump, Detail: "heading h3 follows h1"},
+	}, report.Issues)
+}
+
+func TestCaptionAlt(t *testing.T) {
+	content := `<figure><img src="a.png" /><figcaption><span>Figure 1-1.</span> Pods &amp; nodes</figcaption></figure>` +
+		`<figure><img src="b.png" alt="" /><img src="c.png" alt="Kept" /><figcaption>Two</figcaption></figure>` +
+		`<img src="d.png" />`
+
+	out, changed := captionAlt(content)
+	assert.Equal(t, 2, changed)
+	assert.Equal(t, `<figure><img alt="Figure 1-1. Pods &amp; nodes" src="a.png" /><figcaption><span>Figure 1-1.</span> Pods &amp; nodes</figcaption></figure>`+
+		`<figure><img src="b.png" alt="Two" /><img src="c.png" alt="Kept" /><figcaption>Two</figcaption></figure>`+
+		`<img src="d.png" />`, out)
+}
+
+func TestWriteAuditReport(t *testing.T) {
+	report := AuditReport{Title: "Kubernetes", Images: 1, Issues: []AuditIssue{{Chapter: "ch01.html", Kind: AuditMissingAlt, Detail: "image a.png has no alt text"}}}
+
+	var text bytes.Buffer
+	assert.NoError(t, WriteAuditText(&text, report))
+	assert.Equal(t, "Accessibility audit of Kubernetes\n1 images, 0 tables, 0 alt texts from captions, 1 issues\nch01.html: missing-alt: image a.png has no alt text\n", text.String())
+
+	var out bytes.Buffer
+	assert.NoError(t, WriteAuditJSON(&out, AuditReport{Title: "Kubernetes"}))
+	assert.JSONEq(t, `{"title": "Kubernetes", "images": 0, "tables": 0, "caption_alts": 0, "issues": []}`, out.String())
+
+	assert.Equal(t, "books/Kubernetes.accessibility.json", auditPath("books/Kubernetes.epub", "json"))
+	assert.Equal(t, "books/Kubernetes.accessibility.txt", auditPath("books/Kubernetes.epub", "text"))
+}
+
+func TestWriteChaptersAudit(t *testing.T) {
+	path := writeTestBook(t, JsonBook{
+		Title:    "Kubernetes",
+		Uuid:     "9781491935675",
+		Language: "en",
+		Chapters: []Chapter{
+			{Id: "ch01", Filename: "ch01.html", Order: 1, Title: "One", Content: `<h1>One</h1><figure><img src="https://example.com/a.png" /><figcaption>A pod</figcaption></figure>`, Images: []string{"https://example.com/a.png"}},
+		},
+	}, func(e *Ebook) {
+		e.SetAuditOptions(&AuditOptions{CaptionAlt: true})
+	})
+	defer os.RemoveAll(filepath.Dir(path))
+
+	messages, err := Validate(path)
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+
+	chapter := readEpubFile(t, path, "OEBPS/ch01.html")
+	assert.Contains(t, chapter, `lang="en" xml:lang="en"`)
+	assert.Contains(t, chapter, `alt="A pod"`)
+}
@@ -0,0 +1,217 @@
+package ebook
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+
+	logrus "github.com/Sirupsen/logrus"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// AssetFetcher downloads the cover, images and stylesheets of a book
+type AssetFetcher interface {
+	FetchAsset(url string) ([]byte, error)
+}
+
+// httpFetcher fetches assets without authentication
+type httpFetcher struct{}
+
+func (httpFetcher) FetchAsset(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, errors.New("Error: status code != 200, actual status code '" + resp.Status + "'")
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// coverPageId is the manifest id of the generated cover page
+const coverPageId = "cover-page"
+
+const coverPageFile = "cover.xhtml"
+
+// coverImageFile is the name of the cover image without extension, outside
+// images/ so it never clashes with a chapter image
+const coverImageFile = "cover-image"
+
+// size of a generated cover
+const (
+	coverWidth  = 1200
+	coverHeight = 1800
+	coverMargin = 100
+)
+
+var coverExtensions = map[string]string{
+	"jpeg": "jpg",
+	"png":  "png",
+	"gif":  "gif",
+}
+
+var coverPageTmpl = template.Must(template.New("cover").Parse(`<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head>
+  <meta charset="UTF-8" />
+  <title>Cover</title>
+  <style type="text/css">
+    body { margin: 0; padding: 0; text-align: center; }
+    img { max-width: 100%; max-height: 100%; }
+  </style>
+</head>
+<body epub:type="cover">
+  <img src="{{ .Path }}" alt="Cover" />
+</body>
+</html>
+`))
+
+// writeCover downloads the cover, or generates one when the book has none
+// or the download is not an image, and writes the cover page
+func (e *Ebook) writeCover() {
+	data, format, err := e.fetchCover()
+	if err != nil {
+		logrus.Warn("generating a cover: " + err.Error())
+		data, err = generateCover(e.jsonBook)
+		check(err)
+		format = "png"
+	}
+
+	e.cover = ImageToFetch{
+		File:  e.jsonBook.Cover,
+		Media: "image/" + format,
+		Path:  coverImageFile + "." + coverExtensions[format],
+	}
+	check(ioutil.WriteFile(e.tempBookPath+"/OEBPS/"+e.cover.Path, data, 0644))
+
+	// books from safari mostly start with a cover chapter already
+	if len(e.jsonBook.Chapters) > 0 && isCoverChapter(e.jsonBook.Chapters[0]) {
+		return
+	}
+	f, err := os.Create(e.tempBookPath + "/OEBPS/" + coverPageFile)
+	check(err)
+	defer f.Close()
+	check(coverPageTmpl.Execute(f, e.cover))
+	e.coverPage = true
+}
+
+var svgImageReg = regexp.MustCompile(`(?i)<(svg:)?image[\s>]`)
+
+// isCoverChapter reports whether a chapter shows one image and no text
+func isCoverChapter(chapter Chapter) bool {
+	images := len(imgTagReg.FindAllString(chapter.Content, -1)) + len(svgImageReg.FindAllString(chapter.Content, -1))
+	text := strings.TrimSpace(html.UnescapeString(tagReg.ReplaceAllString(chapter.Content, "")))
+	return images == 1 && text == ""
+}
+
+// fetchCover downloads the cover and detects its image format
+func (e *Ebook) fetchCover() ([]byte, string, error) {
+	if e.jsonBook.Cover == "" {
+		return nil, "", errors.New("the book has no cover")
+	}
+	logrus.Debug("fetch cover " + e.jsonBook.Cover)
+	data, err := e.fetcher.FetchAsset(e.jsonBook.Cover)
+	if err != nil {
+		return nil, "", err
+	}
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", errors.New("the cover is not an image: " + err.Error())
+	}
+	if _, ok := coverExtensions[format]; !ok {
+		return nil, "", errors.New("unsupported cover format " + format)
+	}
+	return data, format, nil
+}
+
+// generateCover draws the title, authors and publisher on a plain cover
+func generateCover(book JsonBook) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, coverWidth, coverHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{0x1f, 0x3a, 0x5f, 0xff}), image.Point{}, draw.Src)
+
+	bold, err := opentype.Parse(gobold.TTF)
+	if err != nil {
+		return nil, err
+	}
+	regular, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		return nil, err
+	}
+
+	y, err := drawCoverText(img, bold, 88, book.Title, 300)
+	if err != nil {
+		return nil, err
+	}
+	draw.Draw(img, image.Rect(coverMargin, y, coverWidth-coverMargin, y+8), image.NewUniform(color.White), image.Point{}, draw.Src)
+	if _, err = drawCoverText(img, regular, 56, strings.Join(book.Author, ", "), y+120); err != nil {
+		return nil, err
+	}
+	if _, err = drawCoverText(img, regular, 44, strings.Join(book.Publisher, ", "), coverHeight-coverMargin); err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, img); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// drawCoverText draws centered lines wrapped to the cover width starting
+// at the baseline y and returns the baseline after the last line
+func drawCoverText(img draw.Image, f *opentype.Font, size float64, text string, y int) (int, error) {
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return y, err
+	}
+	defer face.Close()
+
+	d := &font.Drawer{Dst: img, Src: image.NewUniform(color.White), Face: face}
+	lineHeight := face.Metrics().Height.Ceil()
+	for _, line := range wrapText(face, text, coverWidth-2*coverMargin) {
+		width := d.MeasureString(line).Ceil()
+		d.Dot = fixed.P((coverWidth-width)/2, y)
+		d.DrawString(line)
+		y += lineHeight
+	}
+	return y, nil
+}
+
+// wrapText splits text into lines narrower than width
+func wrapText(face font.Face, text string, width int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if line != "" && font.MeasureString(face, candidate).Ceil() > width {
+			lines = append(lines, line)
+			candidate = word
+		}
+		line = candidate
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
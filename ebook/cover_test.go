@@ -0,0 +1,86 @@
+package ebook
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kkc/safari-books-downloader/utils"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/font/basicfont"
+)
+
+type fakeFetcher map[string][]byte
+
+func (f fakeFetcher) FetchAsset(url string) ([]byte, error) {
+	if data, ok := f[url]; ok {
+		return data, nil
+	}
+	return nil, errors.New("not found " + url)
+}
+
+func newCoverTestEbook(t *testing.T, book JsonBook, fetcher AssetFetcher) *Ebook {
+	dir, err := ioutil.TempDir("", "cover")
+	assert.NoError(t, err)
+	e := &Ebook{jsonBook: book, tempBookPath: dir, fetcher: fetcher, progress: utils.NopProgress}
+	prepareFolder(dir)
+	return e
+}
+
+func TestWriteCoverUsesDownloadedImage(t *testing.T) {
+	var cover bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&cover, image.NewRGBA(image.Rect(0, 0, 10, 15)), nil))
+
+	e := newCoverTestEbook(t, JsonBook{Title: "Go", Cover: "https://example.com/cover"}, fakeFetcher{"https://example.com/cover": cover.Bytes()})
+	defer os.RemoveAll(e.tempBookPath)
+	e.writeCover()
+
+	assert.Equal(t, "cover-image.jpg", e.cover.Path)
+	assert.Equal(t, "image/jpeg", e.cover.Media)
+	assert.True(t, e.coverPage)
+	page, err := ioutil.ReadFile(filepath.Join(e.tempBookPath, "OEBPS", coverPageFile))
+	assert.NoError(t, err)
+	assert.Contains(t, string(page), `<img src="cover-image.jpg" alt="Cover" />`)
+}
+
+func TestWriteCoverGeneratesCoverForErrorPage(t *testing.T) {
+	book := JsonBook{
+		Title:     "A Rather Long Title About Concurrency in Go",
+		Author:    []string{"Jane Doe"},
+		Publisher: []string{"O'Reilly Media, Inc."},
+		Cover:     "https://example.com/cover",
+		Chapters:  []Chapter{{Filename: "cover.html", Content: `<figure><img src="images/cover.png" alt="Cover" /></figure>`}},
+	}
+	e := newCoverTestEbook(t, book, fakeFetcher{"https://example.com/cover": []byte("<html>error</html>")})
+	defer os.RemoveAll(e.tempBookPath)
+	e.writeCover()
+
+	assert.Equal(t, "cover-image.png", e.cover.Path)
+	assert.False(t, e.coverPage, "the book has a cover chapter")
+	data, err := ioutil.ReadFile(filepath.Join(e.tempBookPath, "OEBPS", "cover-image.png"))
+	assert.NoError(t, err)
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, "png", format)
+	assert.Equal(t, coverWidth, config.Width)
+	assert.Equal(t, coverHeight, config.Height)
+}
+
+func TestWrapText(t *testing.T) {
+	// basicfont characters are 7 pixels wide
+	lines := wrapText(basicfont.Face7x13, "one two three four", 7*9)
+	assert.Equal(t, []string{"one two", "three", "four"}, lines)
+	assert.Empty(t, wrapText(basicfont.Face7x13, " ", 70))
+}
+
+func TestIsCoverChapter(t *testing.T) {
+	assert.True(t, isCoverChapter(Chapter{Content: `<div class="cover">&nbsp;<img src="images/cover.jpg" alt=""/></div>`}))
+	assert.True(t, isCoverChapter(Chapter{Content: `<svg><image xlink:href="images/cover.jpg"/></svg>`}))
+	assert.False(t, isCoverChapter(Chapter{Filename: "cover-story.html", Content: `<h1>Cover Story</h1><img src="images/story.jpg"/>`}))
+	assert.False(t, isCoverChapter(Chapter{Filename: "cover.html"}))
+}
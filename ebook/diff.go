@@ -0,0 +1,397 @@
+package ebook
+
+import (
+	"fmt"
+	"html"
+	htmltemplate "html/template"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Kinds of chapter differences
+const (
+	ChapterAdded    = "added"
+	ChapterRemoved  = "removed"
+	ChapterModified = "modified"
+)
+
+// lines of unchanged text shown around a change
+const diffContext = 3
+
+// DiffLine is one line of a text diff, Op is ' ', '-' or '+'
+type DiffLine struct {
+	Op   byte
+	Text string
+}
+
+// ChapterDiff is the difference of one chapter between two books
+type ChapterDiff struct {
+	Kind          string
+	Id            string
+	Filename      string
+	Title         string
+	Lines         []DiffLine
+	AddedImages   []string
+	RemovedImages []string
+}
+
+// BookDiff lists the chapters that differ, in the order of the new book
+// followed by the removed chapters
+type BookDiff struct {
+	Old      string
+	New      string
+	Chapters []ChapterDiff
+}
+
+// Diff compares two versions of a book, matching chapters by id and then
+// by filename
+func Diff(old *JsonBook, updated *JsonBook) BookDiff {
+	diff := BookDiff{Old: old.Title, New: updated.Title}
+
+	matched := make(map[int]bool)
+	find := func(chapter Chapter) (Chapter, bool) {
+		for i, candidate := range old.Chapters {
+			if !matched[i] && candidate.Id == chapter.Id {
+				matched[i] = true
+				return candidate, true
+			}
+		}
+		for i, candidate := range old.Chapters {
+			if !matched[i] && candidate.Filename == chapter.Filename {
+				matched[i] = true
+				return candidate, true
+			}
+		}
+		return Chapter{}, false
+	}
+
+	for _, chapter := range updated.Chapters {
+		before, ok := find(chapter)
+		if !ok {
+			diff.Chapters = append(diff.Chapters, ChapterDiff{
+				Kind:        ChapterAdded,
+				Id:          chapter.Id,
+				Filename:    chapter.Filename,
+				Title:       chapter.Title,
+				Lines:       diffLines(nil, chapterText(chapter.Content)),
+				AddedImages: chapter.Images,
+			})
+			continue
+		}
+
+		added, removed := diffImages(before.Images, chapter.Images)
+		lines := diffLines(chapterText(before.Content), chapterText(chapter.Content))
+		if !hasChanges(lines) && len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+		diff.Chapters = append(diff.Chapters, ChapterDiff{
+			Kind:          ChapterModified,
+			Id:            chapter.Id,
+			Filename:      chapter.Filename,
+			Title:         chapter.Title,
+			Lines:         lines,
+			AddedImages:   added,
+			RemovedImages: removed,
+		})
+	}
+
+	for i, chapter := range old.Chapters {
+		if matched[i] {
+			continue
+		}
+		diff.Chapters = append(diff.Chapters, ChapterDiff{
+			Kind:          ChapterRemoved,
+			Id:            chapter.Id,
+			Filename:      chapter.Filename,
+			Title:         chapter.Title,
+			Lines:         diffLines(chapterText(chapter.Content), nil),
+			RemovedImages: chapter.Images,
+		})
+	}
+	return diff
+}
+
+var blockEndReg = regexp.MustCompile(`(?i)(</(p|div|h[1-6]|li|pre|tr|blockquote|section|figcaption|dt|dd)>|<br\s*/?>)`)
+var tagReg = regexp.MustCompile(`(?s)<[^>]*>`)
+
+// chapterText reduces chapter html to the lines of text a reader sees
+func chapterText(content string) []string {
+	content = strings.Replace(content, "\n", " ", -1)
+	content = blockEndReg.ReplaceAllString(content, "$1\n")
+	content = tagReg.ReplaceAllString(content, "")
+	var lines []string
+	for _, line := range strings.Split(html.UnescapeString(content), "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// maxDiffEdits bounds the work of diffLines, chapters that differ in more
+// lines are shown as removed and added as a whole
+const maxDiffEdits = 2000
+
+// diffLines computes a shortest line diff with the O(ND) algorithm of Myers
+func diffLines(a []string, b []string) []DiffLine {
+	var prefix, suffix []DiffLine
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		prefix = append(prefix, DiffLine{' ', a[0]})
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		suffix = append([]DiffLine{{' ', a[len(a)-1]}}, suffix...)
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	lines := append(prefix, myersDiff(a, b)...)
+	return append(lines, suffix...)
+}
+
+// myersDiff keeps the furthest x of every diagonal k = x - y per edit
+// count d, and walks the saved rounds back from the end to get the edits
+func myersDiff(a []string, b []string) []DiffLine {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	// trace[d] holds v of the diagonals -d..d before round d
+	var trace [][]int
+	for d := 0; d <= n+m; d++ {
+		if d > maxDiffEdits {
+			return coarseDiff(a, b)
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace)
+			}
+		}
+	}
+	return nil
+}
+
+func backtrack(a []string, b []string, trace [][]int) []DiffLine {
+	var reversed []DiffLine
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		at := func(k int) int { return v[k+d] }
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			reversed = append(reversed, DiffLine{' ', a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			reversed = append(reversed, DiffLine{'+', b[y-1]})
+		} else {
+			reversed = append(reversed, DiffLine{'-', a[x-1]})
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		reversed = append(reversed, DiffLine{' ', a[x-1]})
+		x--
+		y--
+	}
+
+	lines := make([]DiffLine, len(reversed))
+	for i, line := range reversed {
+		lines[len(reversed)-1-i] = line
+	}
+	return lines
+}
+
+// coarseDiff removes all of a and adds all of b
+func coarseDiff(a []string, b []string) []DiffLine {
+	var lines []DiffLine
+	for _, line := range a {
+		lines = append(lines, DiffLine{'-', line})
+	}
+	for _, line := range b {
+		lines = append(lines, DiffLine{'+', line})
+	}
+	return lines
+}
+
+func hasChanges(lines []DiffLine) bool {
+	for _, line := range lines {
+		if line.Op != ' ' {
+			return true
+		}
+	}
+	return false
+}
+
+// diffImages returns the images only in updated and only in old, sorted
+func diffImages(old []string, updated []string) (added []string, removed []string) {
+	before := make(map[string]bool)
+	for _, image := range old {
+		before[image] = true
+	}
+	after := make(map[string]bool)
+	for _, image := range updated {
+		after[image] = true
+		if !before[image] {
+			added = append(added, image)
+		}
+	}
+	for _, image := range old {
+		if !after[image] {
+			removed = append(removed, image)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// diffHunk is a run of changed lines with their context
+type diffHunk struct {
+	oldStart, oldCount int
+	newStart, newCount int
+	Lines              []DiffLine
+}
+
+// hunks groups the changes of a diff with diffContext lines around them
+func hunks(lines []DiffLine) []diffHunk {
+	// merge the context ranges of changes that touch
+	var ranges [][2]int
+	for index, line := range lines {
+		if line.Op == ' ' {
+			continue
+		}
+		start, end := index-diffContext, index+diffContext+1
+		if start < 0 {
+			start = 0
+		}
+		if end > len(lines) {
+			end = len(lines)
+		}
+		if n := len(ranges); n > 0 && start <= ranges[n-1][1] {
+			ranges[n-1][1] = end
+		} else {
+			ranges = append(ranges, [2]int{start, end})
+		}
+	}
+
+	var result []diffHunk
+	oldLine, newLine, position := 1, 1, 0
+	for _, r := range ranges {
+		for ; position < r[0]; position++ {
+			oldLine, newLine = oldLine+1, newLine+1
+		}
+		hunk := diffHunk{oldStart: oldLine, newStart: newLine, Lines: lines[r[0]:r[1]]}
+		for ; position < r[1]; position++ {
+			if lines[position].Op != '+' {
+				hunk.oldCount++
+				oldLine++
+			}
+			if lines[position].Op != '-' {
+				hunk.newCount++
+				newLine++
+			}
+		}
+		result = append(result, hunk)
+	}
+	return result
+}
+
+// WriteUnified writes the diff as unified text diffs per chapter
+func WriteUnified(w io.Writer, diff BookDiff) error {
+	for _, chapter := range diff.Chapters {
+		oldName, newName := "a/"+chapter.Filename, "b/"+chapter.Filename
+		switch chapter.Kind {
+		case ChapterAdded:
+			oldName = "/dev/null"
+		case ChapterRemoved:
+			newName = "/dev/null"
+		}
+		if _, err := fmt.Fprintf(w, "%s chapter %s %q\n--- %s\n+++ %s\n", chapter.Kind, chapter.Id, chapter.Title, oldName, newName); err != nil {
+			return err
+		}
+		for _, image := range chapter.RemovedImages {
+			fmt.Fprintf(w, "-image %s\n", image)
+		}
+		for _, image := range chapter.AddedImages {
+			fmt.Fprintf(w, "+image %s\n", image)
+		}
+		for _, hunk := range hunks(chapter.Lines) {
+			fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(hunk.oldStart, hunk.oldCount), hunkRange(hunk.newStart, hunk.newCount))
+			for _, line := range hunk.Lines {
+				if _, err := fmt.Fprintf(w, "%c%s\n", line.Op, line.Text); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// hunkRange formats a range like diff -u, an empty range starts before it
+func hunkRange(start int, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start-1)
+	}
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+var diffReportTmpl = htmltemplate.Must(htmltemplate.New("diff").Funcs(htmltemplate.FuncMap{
+	"hunks": hunks,
+	"op":    func(op byte) string { return string(op) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="UTF-8" />
+  <title>{{ .New }}: changes</title>
+  <style>
+    body { font-family: sans-serif; }
+    pre { background: #f6f8fa; padding: 0.5em; white-space: pre-wrap; }
+    .added { background: #e6ffed; }
+    .removed { background: #ffeef0; }
+  </style>
+</head>
+<body>
+  <h1>{{ .New }}</h1>
+  {{ if not .Chapters }}<p>No chapters changed.</p>{{ end }}
+  {{ range .Chapters }}
+  <h2>{{ .Kind }}: {{ .Title }} <small>({{ .Filename }})</small></h2>
+  {{ if or .AddedImages .RemovedImages }}<ul>
+    {{ range .RemovedImages }}<li class="removed">removed image {{ . }}</li>{{ end }}
+    {{ range .AddedImages }}<li class="added">added image {{ . }}</li>{{ end }}
+  </ul>{{ end }}
+  {{ range hunks .Lines }}<pre>{{ range .Lines }}<div class="{{ if eq (op .Op) "+" }}added{{ else if eq (op .Op) "-" }}removed{{ end }}">{{ op .Op }} {{ .Text }}</div>{{ end }}</pre>
+  {{ end }}
+  {{ end }}
+</body>
+</html>
+`))
+
+// WriteHTML writes the diff as a html report
+func WriteHTML(w io.Writer, diff BookDiff) error {
+	return diffReportTmpl.Execute(w, diff)
+}
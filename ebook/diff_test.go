@@ -0,0 +1,114 @@
+package ebook
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChapterText(t *testing.T) {
+	content := `<h1 id="a">Intro</h1><p>One <em>two</em>
+	three &amp; four</p><br/><pre>code</pre>`
+	assert.Equal(t, []string{"Intro", "One two three & four", "code"}, chapterText(content))
+}
+
+func TestDiffLines(t *testing.T) {
+	lines := diffLines([]string{"a", "b", "c", "d"}, []string{"a", "c", "x", "d"})
+	assert.Equal(t, []DiffLine{{' ', "a"}, {'-', "b"}, {' ', "c"}, {'+', "x"}, {' ', "d"}}, lines)
+	assert.False(t, hasChanges(diffLines([]string{"a"}, []string{"a"})))
+
+	lines = diffLines([]string{"a", "b", "c", "a", "b", "b", "a"}, []string{"c", "b", "a", "b", "a", "c"})
+	removed, added := 0, 0
+	for _, line := range lines {
+		switch line.Op {
+		case '-':
+			removed++
+		case '+':
+			added++
+		}
+	}
+	assert.Equal(t, 5, removed+added)
+}
+
+func TestDiffLinesLimitsEdits(t *testing.T) {
+	var a, b []string
+	for i := 0; i <= maxDiffEdits; i++ {
+		a = append(a, fmt.Sprintf("old %d", i))
+		b = append(b, fmt.Sprintf("new %d", i))
+	}
+	lines := diffLines(append([]string{"same"}, a...), append([]string{"same"}, b...))
+	if assert.Len(t, lines, 2*len(a)+1) {
+		assert.Equal(t, DiffLine{' ', "same"}, lines[0])
+		assert.Equal(t, DiffLine{'-', "old 0"}, lines[1])
+		assert.Equal(t, DiffLine{'+', "new 0"}, lines[len(a)+1])
+	}
+}
+
+func TestDiffMatchesChaptersByIdAndFilename(t *testing.T) {
+	old := &JsonBook{Title: "Book", Chapters: []Chapter{
+		{Id: "ch1", Filename: "ch1.html", Title: "One", Content: "<p>same</p>"},
+		{Id: "old2", Filename: "ch2.html", Title: "Two", Content: "<p>before</p>", Images: []string{"images/a.png"}},
+		{Id: "ch3", Filename: "ch3.html", Title: "Three", Content: "<p>gone</p>"},
+	}}
+	updated := &JsonBook{Title: "Book", Chapters: []Chapter{
+		{Id: "ch1", Filename: "ch1.html", Title: "One", Content: "<p>same</p>"},
+		{Id: "ch2", Filename: "ch2.html", Title: "Two", Content: "<p>after</p>", Images: []string{"images/b.png"}},
+		{Id: "ch4", Filename: "ch4.html", Title: "Four", Content: "<p>new</p>"},
+	}}
+
+	diff := Diff(old, updated)
+	if assert.Len(t, diff.Chapters, 3) {
+		assert.Equal(t, ChapterModified, diff.Chapters[0].Kind)
+		assert.Equal(t, "ch2.html", diff.Chapters[0].Filename)
+		assert.Equal(t, []string{"images/b.png"}, diff.Chapters[0].AddedImages)
+		assert.Equal(t, []string{"images/a.png"}, diff.Chapters[0].RemovedImages)
+		assert.Equal(t, ChapterAdded, diff.Chapters[1].Kind)
+		assert.Equal(t, "ch4", diff.Chapters[1].Id)
+		assert.Equal(t, ChapterRemoved, diff.Chapters[2].Kind)
+		assert.Equal(t, "ch3", diff.Chapters[2].Id)
+	}
+}
+
+func TestWriteUnified(t *testing.T) {
+	var lines []string
+	for _, line := range "abcdefghijklmn" {
+		lines = append(lines, string(line))
+	}
+	changed := append([]string(nil), lines...)
+	changed[1] = "B"
+	changed[12] = "M"
+
+	diff := BookDiff{Chapters: []ChapterDiff{{
+		Kind:     ChapterModified,
+		Id:       "ch1",
+		Filename: "ch1.html",
+		Title:    "One",
+		Lines:    diffLines(lines, changed),
+	}}}
+	var out bytes.Buffer
+	assert.NoError(t, WriteUnified(&out, diff))
+	assert.Equal(t, `modified chapter ch1 "One"
+--- a/ch1.html
++++ b/ch1.html
+@@ -1,5 +1,5 @@
+ a
+-b
++B
+ c
+ d
+ e
+@@ -10,5 +10,5 @@
+ j
+ k
+ l
+-m
++M
+ n
+`, out.String())
+
+	out.Reset()
+	assert.NoError(t, WriteHTML(&out, diff))
+	assert.Contains(t, out.String(), `<div class="added">&#43; M</div>`)
+}
@@ -3,18 +3,18 @@ package ebook
 import (
 	"archive/zip"
 	"encoding/json"
-	"errors"
-	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
-	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"text/template"
 	"time"
+
+	"github.com/kkc/safari-books-downloader/utils"
+
+	logrus "github.com/Sirupsen/logrus"
 )
 
 // Ebook Chapter
@@ -27,25 +27,33 @@ type Chapter struct {
 	Id             string
 	Order          int
 	StylesheetsURL []string
+	Unchanged      bool
+	// Properties are the manifest properties, set when the chapter is written
+	Properties string
 }
 
 // Ebook OebpsContent
 type OebpsContent struct {
-	Title   string
-	Content string
-	CoreCSS string
+	Title       string
+	Language    string
+	Content     string
+	Stylesheets string
 }
 
 type JsonBook struct {
-	Title       string
-	Uuid        string
-	Language    string
-	Author      []string
-	Cover       string
-	Description string
-	Publisher   []string
-	Stylesheet  string
-	Chapters    []Chapter
+	Title        string
+	Uuid         string
+	Language     string
+	Author       []string
+	Cover        string
+	Description  string
+	Publisher    []string
+	Isbn         string
+	Issued       string
+	Updated      time.Time
+	LastModified time.Time
+	Stylesheet   string
+	Chapters     []Chapter
 }
 
 type ImageToFetch struct {
@@ -53,12 +61,29 @@ type ImageToFetch struct {
 	File    string
 	Media   string
 	Path    string
+	// Unchanged images belong to chapters reused from the last download
+	Unchanged bool
 }
 
 type Ebook struct {
 	jsonBook     JsonBook
 	tempBookPath string
 	images       []ImageToFetch
+	cover        ImageToFetch
+	coverPage    bool
+	fetcher      AssetFetcher
+	concurrency  int
+	imageOptions *ImageOptions
+	mathFallback string
+	// popupFootnotes converts footnotes to EPUB 3 notes
+	popupFootnotes bool
+	codeOptions    *CodeOptions
+	style          StyleOptions
+	accessibility  *AccessibilityProfile
+	auditOptions   *AuditOptions
+	auditReport    AuditReport
+	highlights     []Highlight
+	progress       utils.ProgressReporter
 }
 
 func check(e error) {
@@ -98,12 +123,17 @@ func writeContainer(tempBookPath string) {
 }
 
 func NewEbook(jsonInput []byte) *Ebook {
+	return NewEbookWithCacheDir(jsonInput, "books")
+}
+
+// NewEbookWithCacheDir builds the book below cacheDir instead of ./books
+func NewEbookWithCacheDir(jsonInput []byte, cacheDir string) *Ebook {
 	var jsonBook JsonBook
 	err := json.Unmarshal(jsonInput, &jsonBook)
 	if err != nil {
-		log.Fatal(err)
+		logrus.Fatal(err)
 	}
-	tempBookPath := "books/" + jsonBook.Uuid
+	tempBookPath := filepath.Join(cacheDir, jsonBook.Uuid)
 	prepareFolder(tempBookPath)
 	writeMimeType(tempBookPath)
 	writeContainer(tempBookPath)
@@ -111,27 +141,94 @@ func NewEbook(jsonInput []byte) *Ebook {
 	ebook := &Ebook{
 		jsonBook:     jsonBook,
 		tempBookPath: tempBookPath,
+		fetcher:      httpFetcher{},
+		concurrency:  4,
+		progress:     utils.NopProgress,
 	}
 	return ebook
 }
 
+// Metadata returns the book without its chapters
+func (e *Ebook) Metadata() JsonBook {
+	book := e.jsonBook
+	book.Chapters = nil
+	return book
+}
+
+// SetFetcher sets how the cover, images and stylesheets are downloaded
+func (e *Ebook) SetFetcher(fetcher AssetFetcher) {
+	e.fetcher = fetcher
+}
+
+// SetProgress sets the reporter receiving the progress of Save
+func (e *Ebook) SetProgress(progress utils.ProgressReporter) {
+	e.progress = progress
+}
+
 // Saves the epub to the specified path
 func (e *Ebook) Save(outputPath string) {
 	if outputPath == "" {
 		outputPath = "ebook.epub"
 	}
+	e.progress.Report(utils.ProgressEvent{Type: utils.PhaseStart, Phase: "images"})
 	e.downloadImages()
+	if e.imageOptions != nil {
+		e.optimizeImages()
+	}
+	e.progress.Report(utils.ProgressEvent{Type: utils.PhaseFinish, Phase: "images"})
+
+	e.writeBook()
+
+	e.progress.Report(utils.ProgressEvent{Type: utils.PhaseStart, Phase: "package"})
+	e.generateEpub(outputPath)
+	e.progress.Report(utils.ProgressEvent{Type: utils.PhaseFinish, Phase: "package", Message: outputPath})
+	e.validate(outputPath)
+	if e.auditOptions != nil && e.auditOptions.Format != "" {
+		e.writeAudit(outputPath)
+	}
+}
+
+// writeBook writes the chapters, the metadata and the stylesheets of a book
+// whose images are downloaded
+func (e *Ebook) writeBook() {
+	e.uniqueChapterIds()
+	e.addNotesChapter()
+	e.progress.Report(utils.ProgressEvent{Type: utils.PhaseStart, Phase: "write", Total: len(e.jsonBook.Chapters)})
 	e.writeChapters()
+	e.writeCover()
 	e.writeContentOPF()
 	e.writeTOC()
-	e.downloadCoverImage()
 	e.writeCSS()
-	e.downloadStylesheet()
-	e.generateEpub(outputPath)
+	if e.publisherCSS() {
+		e.downloadStylesheet()
+	}
+	e.progress.Report(utils.ProgressEvent{Type: utils.PhaseFinish, Phase: "write"})
+}
+
+// validate logs the problems of a saved epub, it never stops the download
+func (e *Ebook) validate(outputPath string) {
+	messages, err := Validate(outputPath)
+	if err != nil {
+		logrus.Warn("could not validate " + outputPath + ": " + err.Error())
+		return
+	}
+	for _, message := range messages {
+		logrus.Warn(message.String())
+	}
+}
+
+// imageMediaType guesses the media type of an image from its extension
+func imageMediaType(name string) string {
+	if media, ok := extensionMediaTypes[strings.ToLower(filepath.Ext(name))]; ok {
+		return media
+	}
+	return "image/png"
 }
 
-func (e *Ebook) downloadImages() {
+// collectImages lists the images of all chapters for the manifest
+func (e *Ebook) collectImages() {
 	var images []ImageToFetch
+	seen := make(map[string]int)
 	for _, chapter := range e.jsonBook.Chapters {
 		baseUrl := chapter.AssetBaseURL
 		for _, image := range chapter.Images {
@@ -141,42 +238,34 @@ func (e *Ebook) downloadImages() {
 			if pathArrayLen > 1 {
 				imagePath = pathArray[pathArrayLen-1]
 			}
-			//mediaType, a, err := mime.ParseMediaType(image)
+			// images used by several chapters are stored once
+			if index, ok := seen[image]; ok {
+				images[index].Unchanged = images[index].Unchanged && chapter.Unchanged
+				continue
+			}
+			seen[image] = len(images)
 			images = append(images, ImageToFetch{
-				BaseUrl: baseUrl,
-				File:    image,
-				Media:   "image/png",
-				Path:    "images/" + imagePath,
+				BaseUrl:   baseUrl,
+				File:      image,
+				Media:     imageMediaType(imagePath),
+				Path:      "images/" + imagePath,
+				Unchanged: chapter.Unchanged,
 			})
 		}
 	}
 
 	e.images = images
+}
 
-	// download images
-	// TODO: wrap this as smaller function
-	for _, image := range images {
-		url := image.BaseUrl + image.File
-		fmt.Println("fetch uri " + url)
-		req, err := http.NewRequest("GET", url, nil)
-		check(err)
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		defer resp.Body.Close()
-
-		if resp.StatusCode != 200 {
-			err = errors.New("Error: status code != 200, actual status code '" + resp.Status + "'")
-			panic(err)
+// imagePath is where a chapter image is stored in the book, images renamed
+// by optimizeImages are looked up in e.images
+func (e *Ebook) imagePath(image string, name string) string {
+	for _, i := range e.images {
+		if i.File == image {
+			return i.Path
 		}
-
-		body, err := ioutil.ReadAll(resp.Body)
-		check(err)
-		f, err := os.Create(e.tempBookPath + "/OEBPS/" + image.Path)
-		check(err)
-		defer f.Close()
-
-		f.Write(body)
 	}
+	return "images/" + name
 }
 
 // Write Chapters to epub file
@@ -184,19 +273,19 @@ func (e *Ebook) writeChapters() {
 
 	var chapterTmpl = `<?xml version="1.0" encoding="UTF-8" standalone="no"?>
 <!DOCTYPE html>
-<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xmlns:m="http://www.w3.org/1998/Math/MathML" xmlns:pls="http://www.w3.org/2005/01/pronunciation-lexicon" xmlns:ssml="http://www.w3.org/2001/10/synthesis" xmlns:svg="http://www.w3.org/2000/svg">
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xmlns:m="http://www.w3.org/1998/Math/MathML" xmlns:pls="http://www.w3.org/2005/01/pronunciation-lexicon" xmlns:ssml="http://www.w3.org/2001/10/synthesis" xmlns:svg="http://www.w3.org/2000/svg"{{ if .Language }} lang="{{ .Language }}" xml:lang="{{ .Language }}"{{ end }}>
 <head>
   <meta charset="UTF-8" />
-  <title>{{ .Title }}</title>
-  <link type="text/css" rel="stylesheet" media="all" href="style.css" />
-  {{ .CoreCSS }}
+  <title>{{ xml .Title }}</title>
+  {{ .Stylesheets }}
 </head>
 <body>
   {{ .Content }}
 </body>
 </html>
 `
-	for _, chapter := range e.jsonBook.Chapters {
+	e.auditReport = AuditReport{Title: e.jsonBook.Title}
+	for index, chapter := range e.jsonBook.Chapters {
 		var chapterContent = chapter.Content
 		//TODO: replace the image source with the new local source
 		for _, image := range chapter.Images {
@@ -207,30 +296,43 @@ func (e *Ebook) writeChapters() {
 				imagePath = pathArray[pathArrayLen-1]
 			}
 			reg := regexp.MustCompile(`[^"]*` + image)
-			rep := "images/" + imagePath
+			rep := e.imagePath(image, imagePath)
 			chapterContent = reg.ReplaceAllString(chapterContent, rep)
 		}
 
-		coreCSS := ""
-		if e.jsonBook.Stylesheet != "" {
-			coreCSS = `<link type="text/css" rel="stylesheet" media="all" href="core.css" />`
-		}
-
 		chapterContent = e.purifyHTML(chapterContent)
+		if e.popupFootnotes {
+			chapterContent = convertFootnotes(chapterContent)
+		}
+		if e.codeOptions != nil {
+			chapterContent = highlightCode(chapterContent, *e.codeOptions)
+		}
+		chapterContent = e.replaceMath(chapterContent)
+		e.jsonBook.Chapters[index].Properties = chapterProperties(chapterContent)
+		if e.auditOptions != nil {
+			if e.auditOptions.CaptionAlt {
+				var changed int
+				chapterContent, changed = captionAlt(chapterContent)
+				e.auditReport.CaptionAlts += changed
+			}
+			e.auditReport.auditChapter(chapter, chapterContent, e.jsonBook.Language)
+		}
 		c := &OebpsContent{
-			Title:   chapter.Title,
-			Content: chapterContent,
-			CoreCSS: coreCSS,
+			Title:       chapter.Title,
+			Language:    e.jsonBook.Language,
+			Content:     chapterContent,
+			Stylesheets: e.stylesheetLinks(),
 		}
 
 		f, err := os.Create(e.tempBookPath + "/OEBPS/" + chapter.Filename)
 		check(err)
 		defer f.Close()
 
-		t := template.New("chapter")
+		t := template.New("chapter").Funcs(templateFuncs)
 		t, _ = t.Parse(chapterTmpl)
 		err = t.Execute(f, c)
 		check(err)
+		e.progress.Report(utils.ProgressEvent{Type: utils.ChapterDone, Current: index + 1, Total: len(e.jsonBook.Chapters)})
 	}
 }
 
@@ -241,50 +343,60 @@ func (e *Ebook) writeContentOPF() {
 	isoDate := t.UTC().Format("2006-01-02T15:04:05-0700Z")
 
 	data := struct {
-		Title       string
-		Uuid        string
-		Language    string
-		Author      string
-		Cover       string
-		Description string
-		Publisher   string
-		Stylesheet  string
-		Chapters    []Chapter
-		Date        string
-		ISODate     string
-		DateYear    int
-		Creator     string
-		Images      []ImageToFetch
+		Title         string
+		Uuid          string
+		Language      string
+		Author        string
+		Authors       []string
+		Cover         string
+		Description   string
+		Publisher     string
+		Issued        string
+		Stylesheet    string
+		Chapters      []Chapter
+		Date          string
+		ISODate       string
+		DateYear      int
+		Creator       string
+		Images        []ImageToFetch
+		CoverImage    ImageToFetch
+		CoverPage     string
+		UserCSS       bool
+		Accessibility *opfAccessibility
 	}{
 		Title:       e.jsonBook.Title,
 		Uuid:        e.jsonBook.Uuid,
 		Language:    e.jsonBook.Language,
 		Author:      strings.Join(e.jsonBook.Author, " "),
+		Authors:     e.jsonBook.Author,
 		Cover:       e.jsonBook.Cover,
 		Description: e.jsonBook.Description,
 		Publisher:   strings.Join(e.jsonBook.Publisher, ""),
+		Issued:      e.jsonBook.Issued,
 		Stylesheet:  e.jsonBook.Stylesheet,
-		Chapters:    e.jsonBook.Chapters,
-		Date:        date,
-		ISODate:     isoDate,
-		DateYear:    t.UTC().Year(),
-		Creator:     strings.Join(e.jsonBook.Author, " "),
-		Images:      e.images,
+		UserCSS:     e.style.UserCSS != "",
+
+		Accessibility: e.accessibilityMetadata(),
+		Chapters:      e.jsonBook.Chapters,
+		Date:          date,
+		ISODate:       isoDate,
+		DateYear:      t.UTC().Year(),
+		Creator:       strings.Join(e.jsonBook.Author, " "),
+		Images:        e.images,
+		CoverImage:    e.cover,
+	}
+	if !e.publisherCSS() {
+		data.Stylesheet = ""
+	}
+	if e.coverPage {
+		data.CoverPage = coverPageFile
 	}
 
 	f, err := os.Create(e.tempBookPath + "/OEBPS/content.opf")
 	check(err)
 	defer f.Close()
 
-	temp := template.New("opf.tmpl")
-	cwd, err := os.Getwd()
-	check(err)
-	temp, err = temp.ParseFiles(filepath.Join(cwd, "/ebook/opf.tmpl"))
-	check(err)
-
-	fmt.Println(data)
-	err = temp.Execute(f, data)
-	fmt.Println(err)
+	err = opfTmpl.Execute(f, data)
 	check(err)
 }
 
@@ -304,93 +416,99 @@ func (e *Ebook) writeTOC() {
 		Author:   strings.Join(e.jsonBook.Author, " "),
 		Chapters: e.jsonBook.Chapters,
 	}
-	temp := template.New("toc.ncx.tmpl")
-	cwd, err := os.Getwd()
-	check(err)
-	temp, err = temp.ParseFiles(filepath.Join(cwd, "./ebook/toc.ncx.tmpl"))
-	check(err)
-	err = temp.Execute(f, data)
-	check(err)
-
-}
-
-func (e *Ebook) downloadCoverImage() {
-
-	out, err := os.Create(e.tempBookPath + "/OEBPS/images/cover.jpg")
-	check(err)
-	defer out.Close()
-
-	resp, err := http.Get(e.jsonBook.Cover)
-	check(err)
-	defer resp.Body.Close()
-
-	_, err = io.Copy(out, resp.Body)
+	err = tocTmpl.Execute(f, data)
 	check(err)
 }
 
 // creates the style.css file in the OEBPS directory
 func (e *Ebook) writeCSS() {
-	cwd, err := os.Getwd()
-	check(err)
-	in, err := os.Open(filepath.Join(cwd, "./ebook/style.css"))
-	check(err)
-	defer in.Close()
-
 	out, err := os.Create(e.tempBookPath + "/OEBPS/style.css")
 	check(err)
 	defer out.Close()
 
-	_, err = io.Copy(out, in)
-	check(err)
+	e.writeTheme(out)
+	if e.codeOptions != nil {
+		check(writeCodeCSS(out, *e.codeOptions))
+	}
+	if e.accessibility != nil {
+		check(writeAccessibilityCSS(out, *e.accessibility))
+	}
+	if len(e.highlights) > 0 {
+		check(writeHighlightsCSS(out))
+	}
+	e.writeUserCSS()
 }
 
+// downloadStylesheet saves the publisher stylesheet as core.css, the file
+// stays empty when it cannot be downloaded
 func (e *Ebook) downloadStylesheet() {
-	out, err := os.Create(e.tempBookPath + "/OEBPS/core.css")
-	check(err)
-	defer out.Close()
-
-	fmt.Println(e.jsonBook.Stylesheet)
-	resp, err := http.Get(e.jsonBook.Stylesheet)
-	check(err)
-	defer resp.Body.Close()
-
-	_, err = io.Copy(out, resp.Body)
-	check(err)
+	logrus.Debug("fetch stylesheet " + e.jsonBook.Stylesheet)
+	data, err := e.fetcher.FetchAsset(e.jsonBook.Stylesheet)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"Stylesheet": e.jsonBook.Stylesheet,
+		}).Warn("leaving out the publisher stylesheet: " + err.Error())
+		data = nil
+	}
+	check(ioutil.WriteFile(e.tempBookPath+"/OEBPS/core.css", data, 0644))
 }
 
 // Generates and saves the epub book
 func (e *Ebook) generateEpub(path string) {
-	fmt.Println("Zipping temp dir to " + path)
-	filesNeedToBeArchived := []string{
-		e.tempBookPath + "/mimetype",
-		e.tempBookPath + "/META-INF",
-		e.tempBookPath + "/OEBPS",
+	logrus.Info("Zipping temp dir to " + path)
+	if dir := filepath.Dir(path); dir != "" {
+		check(os.MkdirAll(dir, os.ModePerm))
 	}
-	err := zipit(filesNeedToBeArchived, path)
+	err := zipit(e.tempBookPath, e.packageFiles(), path)
 	check(err)
 }
 
-func (e *Ebook) purifyHTML(content string) string {
-	// area,base,basefont,br,col,frame,hr,img,input,isindex,keygen,link,meta,menuitem,source,track,param,embed,wbr
-	// <(\s?img[^>]*[^\/])>
-	result := content
-	for _, ele := range [1]string{"img"} {
-		reg := regexp.MustCompile(`<(\s?` + ele + `[^>]*[^\/])>`)
-		rep := "<${1} />"
-		result = reg.ReplaceAllString(result, rep)
+// packageFiles lists the files of the book below tempBookPath, the mimetype
+// first. Files left in the build directory by earlier downloads are not in
+// the manifest and stay out of the book.
+func (e *Ebook) packageFiles() []string {
+	files := []string{"mimetype", "META-INF/container.xml", "OEBPS/content.opf", "OEBPS/toc.ncx", "OEBPS/style.css"}
+	if e.publisherCSS() {
+		files = append(files, "OEBPS/core.css")
+	}
+	if e.style.UserCSS != "" {
+		files = append(files, "OEBPS/"+userCSSFile)
+	}
+	files = append(files, "OEBPS/"+e.cover.Path)
+	if e.coverPage {
+		files = append(files, "OEBPS/"+coverPageFile)
+	}
+	for _, image := range e.images {
+		files = append(files, "OEBPS/"+image.Path)
+	}
+	for _, chapter := range e.jsonBook.Chapters {
+		files = append(files, "OEBPS/"+chapter.Filename)
 	}
 
-	for _, ele := range [2]string{"br", "hr"} {
-		reg := regexp.MustCompile(`<\s?` + ele + `[^>]*>`)
-		rep := "<" + ele + "/>"
-		result = reg.ReplaceAllString(result, rep)
+	var unique []string
+	seen := make(map[string]bool)
+	for _, file := range files {
+		if !seen[file] {
+			seen[file] = true
+			unique = append(unique, file)
+		}
 	}
-	return result
+	return unique
+}
+
+func (e *Ebook) purifyHTML(content string) string {
+	// area,base,basefont,br,col,frame,hr,img,input,isindex,keygen,link,meta,menuitem,source,track,param,embed,wbr
+	// the tag names match exactly, so svg and MathML elements keep their own closing
+	result := imgTagReg.ReplaceAllString(content, "<img${1} />")
+	return breakTagReg.ReplaceAllString(result, "<${1}${2}/>")
 }
 
-// rewrite it from https://gist.github.com/svett/424e6784facc0ba907ae
-// TODO: can be replaced to utils.go
-func zipit(sources []string, target string) error {
+var imgTagReg = regexp.MustCompile(`<\s?img(\s[^>]*?)??\s*/?>`)
+var breakTagReg = regexp.MustCompile(`<\s?(br|hr)(\s[^>]*?)??\s*/?>`)
+
+// zipit archives the files below root under their relative names, the
+// mimetype is stored uncompressed as readers expect
+func zipit(root string, files []string, target string) error {
 	zipfile, err := os.Create(target)
 	if err != nil {
 		return err
@@ -400,55 +518,33 @@ func zipit(sources []string, target string) error {
 	archive := zip.NewWriter(zipfile)
 	defer archive.Close()
 
-	for _, source := range sources {
-		info, err := os.Stat(source)
+	for _, name := range files {
+		info, err := os.Stat(filepath.Join(root, name))
 		if err != nil {
-			return nil
+			return err
 		}
-
-		var baseDir string
-		if info.IsDir() {
-			baseDir = filepath.Base(source)
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
 		}
-
-		filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-
-			header, err := zip.FileInfoHeader(info)
-			if err != nil {
-				return err
-			}
-
-			if baseDir != "" {
-				header.Name = filepath.Join(baseDir, strings.TrimPrefix(path, source))
-			}
-
-			if info.IsDir() {
-				header.Name += "/"
-			} else {
-				header.Method = zip.Deflate
-			}
-
-			writer, err := archive.CreateHeader(header)
-			if err != nil {
-				return err
-			}
-
-			if info.IsDir() {
-				return nil
-			}
-
-			file, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
-			_, err = io.Copy(writer, file)
+		header.Name = name
+		header.Method = zip.Deflate
+		if name == "mimetype" {
+			header.Method = zip.Store
+		}
+		writer, err := archive.CreateHeader(header)
+		if err != nil {
 			return err
-		})
+		}
+		file, err := os.Open(filepath.Join(root, name))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(writer, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
 	}
-
-	return err
+	return nil
 }
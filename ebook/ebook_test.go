@@ -56,12 +56,12 @@ func TestWriteTOC(t *testing.T) {
 
 }
 
-func TestDownloadCoverImage(t *testing.T) {
+func TestWriteCover(t *testing.T) {
 	content, err := iotil.ReadFile("./resp_sample")
 	assert.NoError(t, err)
 
 	ebook := NewEbook(content)
-	ebook.downloadCoverImage()
+	ebook.writeCover()
 }
 
 func TestWriteCSS(t *testing.T) {
@@ -87,9 +87,9 @@ func TestGenerateEpub(t *testing.T) {
 	ebook := NewEbook(content)
 	ebook.downloadImages()
 	ebook.writeChapters()
+	ebook.writeCover()
 	ebook.writeContentOPF()
 	ebook.writeTOC()
-	ebook.downloadCoverImage()
 	ebook.writeCSS()
 	ebook.downloadStylesheet()
 	ebook.generateEpub("ebook.epub")
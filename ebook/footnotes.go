@@ -0,0 +1,144 @@
+package ebook
+
+import (
+	"regexp"
+	"strings"
+)
+
+// SetPopupFootnotes turns the conversion of footnotes to EPUB 3 notes on or
+// off, it is off by default
+func (e *Ebook) SetPopupFootnotes(enabled bool) {
+	e.popupFootnotes = enabled
+}
+
+// noteBodyReg finds the elements that may hold a footnote or an endnote
+var noteBodyReg = regexp.MustCompile(`(?i)<(p|div|section|aside|li)(\s[^>]*)?>`)
+var dataTypeAttrReg = regexp.MustCompile(`(?i)\sdata-type="([^"]*)"`)
+var epubTypeAttrReg = regexp.MustCompile(`(?i)\sepub:type="([^"]*)"`)
+var classAttrReg = regexp.MustCompile(`(?i)\sclass="([^"]*)"`)
+var idAttrReg = regexp.MustCompile(`\sid="([^"]*)"`)
+var anchorIdReg = regexp.MustCompile(`<a(?:\s[^>]*?)?\sid="([^"]*)"[^>]*>`)
+var anchorReg = regexp.MustCompile(`<a\s[^>]*>`)
+var localHrefReg = regexp.MustCompile(`\shref="#([^"]*)"`)
+
+// noteKind returns footnote or endnote for the attributes of a note body.
+// O'Reilly marks notes with data-type, DocBook books with a class.
+func noteKind(tag string, attributes string) string {
+	if match := dataTypeAttrReg.FindStringSubmatch(attributes); match != nil {
+		switch strings.ToLower(match[1]) {
+		case "footnote":
+			return "footnote"
+		case "endnote":
+			return "endnote"
+		}
+		return ""
+	}
+	if strings.EqualFold(tag, "li") || strings.EqualFold(tag, "aside") {
+		return ""
+	}
+	if match := classAttrReg.FindStringSubmatch(attributes); match != nil {
+		for _, class := range strings.Fields(strings.ToLower(match[1])) {
+			if class == "footnote" || class == "endnote" {
+				return class
+			}
+		}
+	}
+	return ""
+}
+
+// convertFootnotes turns footnotes and endnotes into asides marked with
+// epub:type and their references into noterefs, so readers show them as
+// popups instead of jumping to the end of the chapter
+func convertFootnotes(content string) string {
+	notes := make(map[string]bool)
+
+	var out strings.Builder
+	for {
+		loc := noteBodyReg.FindStringSubmatchIndex(content)
+		if loc == nil {
+			out.WriteString(content)
+			break
+		}
+		tag := content[loc[2]:loc[3]]
+		attributes := ""
+		if loc[4] >= 0 {
+			attributes = content[loc[4]:loc[5]]
+		}
+		kind := noteKind(tag, attributes)
+		if kind == "" || epubTypeAttrReg.MatchString(attributes) {
+			out.WriteString(content[:loc[1]])
+			content = content[loc[1]:]
+			continue
+		}
+
+		end := closingTag(content, tag, loc[1])
+		out.WriteString(content[:loc[0]])
+		id, note := noteBody(tag, content[loc[0]:end], kind)
+		if id != "" {
+			notes[id] = true
+		}
+		out.WriteString(note)
+		content = content[end:]
+	}
+
+	return anchorReg.ReplaceAllStringFunc(out.String(), func(anchor string) string {
+		if epubTypeAttrReg.MatchString(anchor) {
+			return anchor
+		}
+		match := localHrefReg.FindStringSubmatch(anchor)
+		dataType := dataTypeAttrReg.FindStringSubmatch(anchor)
+		if (match != nil && notes[match[1]]) || (dataType != nil && strings.EqualFold(dataType[1], "noteref")) {
+			return strings.TrimSuffix(anchor, ">") + ` epub:type="noteref" role="doc-noteref">`
+		}
+		return anchor
+	})
+}
+
+// noteBody marks one note element and returns the id the references use.
+// List items and asides are marked in place, other elements are wrapped in
+// an aside that takes over their id, or the id of their first anchor.
+func noteBody(tag string, element string, kind string) (string, string) {
+	marker := ` epub:type="` + kind + `" role="doc-` + kind + `"`
+	openEnd := strings.Index(element, ">") + 1
+	open := strings.TrimSuffix(element[:openEnd], ">")
+	body := element[openEnd:]
+
+	id := ""
+	if match := idAttrReg.FindStringSubmatch(open); match != nil {
+		id = match[1]
+	}
+	if strings.EqualFold(tag, "li") || strings.EqualFold(tag, "aside") {
+		return id, open + marker + ">" + body
+	}
+
+	if id != "" {
+		open = idAttrReg.ReplaceAllString(open, "")
+	} else if match := anchorIdReg.FindStringSubmatch(body); match != nil {
+		id = match[1]
+		anchor := strings.Replace(match[0], ` id="`+id+`"`, "", 1)
+		body = strings.Replace(body, match[0], anchor, 1)
+	}
+	aside := `<aside` + marker
+	if id != "" {
+		aside += ` id="` + id + `"`
+	}
+	return id, aside + ">" + open + ">" + body + "</aside>"
+}
+
+// closingTag returns the offset after the tag closing the element opened
+// before from, or the end of content when it is never closed
+func closingTag(content string, tag string, from int) int {
+	tagReg := regexp.MustCompile(`(?i)<(/?)` + tag + `(\s[^>]*)?>`)
+	depth := 1
+	for _, loc := range tagReg.FindAllStringSubmatchIndex(content[from:], -1) {
+		if loc[3] > loc[2] {
+			depth--
+		} else if !strings.HasSuffix(content[from+loc[0]:from+loc[1]], "/>") {
+			depth++
+		}
+		if depth == 0 {
+			return from + loc[1]
+		}
+	}
+	return len(content)
+}
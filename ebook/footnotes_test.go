@@ -0,0 +1,55 @@
+package ebook
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvertOReillyFootnotes(t *testing.T) {
+	input := `<p>Pods<sup><a data-type="noteref" id="idm1-marker" href="#idm1">1</a></sup> run.</p>` +
+		`<div data-type="footnotes"><p data-type="footnote" id="idm1"><sup><a href="#idm1-marker">1</a></sup> A <em>pod</em> is a group.</p></div>`
+
+	assert.Equal(t, `<p>Pods<sup><a data-type="noteref" id="idm1-marker" href="#idm1" epub:type="noteref" role="doc-noteref">1</a></sup> run.</p>`+
+		`<div data-type="footnotes"><aside epub:type="footnote" role="doc-footnote" id="idm1"><p data-type="footnote"><sup><a href="#idm1-marker">1</a></sup> A <em>pod</em> is a group.</p></aside></div>`,
+		convertFootnotes(input))
+}
+
+func TestConvertDocBookFootnotes(t *testing.T) {
+	input := `<p>Text<sup>[<a id="id1" href="#ftn.id1" class="footnote">1</a>]</sup></p>` +
+		`<div class="footnotes"><div class="footnote"><p><a id="ftn.id1" href="#id1"><sup>[1]</sup></a> First <div>nested</div> note.</p></div></div>`
+
+	assert.Equal(t, `<p>Text<sup>[<a id="id1" href="#ftn.id1" class="footnote" epub:type="noteref" role="doc-noteref">1</a>]</sup></p>`+
+		`<div class="footnotes"><aside epub:type="footnote" role="doc-footnote" id="ftn.id1"><div class="footnote"><p><a href="#id1"><sup>[1]</sup></a> First <div>nested</div> note.</p></div></aside></div>`,
+		convertFootnotes(input))
+}
+
+func TestConvertEndnotesInPlace(t *testing.T) {
+	input := `<ol><li data-type="endnote" id="n1">See the spec.</li><li id="n2">Not a note.</li></ol><a href="#n2">2</a>`
+
+	assert.Equal(t, `<ol><li data-type="endnote" id="n1" epub:type="endnote" role="doc-endnote">See the spec.</li><li id="n2">Not a note.</li></ol><a href="#n2">2</a>`,
+		convertFootnotes(input))
+
+	// notes that are marked already are kept
+	marked := `<aside epub:type="footnote" id="n3" data-type="footnote">x</aside>`
+	assert.Equal(t, marked, convertFootnotes(marked))
+}
+
+func TestConvertedFootnotesValidate(t *testing.T) {
+	content := `<p>Pods<sup><a data-type="noteref" id="m1" href="#f1">1</a></sup></p><div data-type="footnotes"><p data-type="footnote" id="f1"><a href="#m1">1</a> note</p></div>`
+	path := writeTestBook(t, JsonBook{
+		Title:    "Kubernetes",
+		Uuid:     "9781491935675",
+		Language: "en",
+		Chapters: []Chapter{
+			{Id: "ch01", Filename: "ch01.html", Order: 1, Title: "One", Content: convertFootnotes(content)},
+		},
+	})
+	defer os.RemoveAll(filepath.Dir(path))
+
+	messages, err := Validate(path)
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+}
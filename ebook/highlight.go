@@ -0,0 +1,181 @@
+package ebook
+
+import (
+	"errors"
+	"html"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma"
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+
+	logrus "github.com/Sirupsen/logrus"
+)
+
+// CodeOptions configure the syntax highlighting of code listings
+type CodeOptions struct {
+	// Theme is light or dark
+	Theme string
+	// Wrap lets long lines wrap on narrow screens instead of scrolling
+	Wrap bool
+}
+
+// codeThemes maps the themes to chroma styles
+var codeThemes = map[string]string{
+	"light": "github",
+	"dark":  "monokai",
+}
+
+// lines longer than this get soft-wrap hints
+const codeWrapColumn = 60
+
+// CodeThemes lists the theme names
+func CodeThemes() []string {
+	var names []string
+	for name := range codeThemes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckCodeTheme reports an unknown theme
+func CheckCodeTheme(theme string) error {
+	if _, ok := codeThemes[theme]; !ok {
+		return errors.New("unknown code theme " + theme + ", expected one of " + strings.Join(CodeThemes(), ", "))
+	}
+	return nil
+}
+
+// SetCodeOptions turns on syntax highlighting, nil turns it off
+func (e *Ebook) SetCodeOptions(options *CodeOptions) {
+	e.codeOptions = options
+}
+
+var codeBlockReg = regexp.MustCompile(`(?is)(<pre\s[^>]*data-code-language="([^"]*)"[^>]*>)(.*?)</pre>`)
+var codeWrapperReg = regexp.MustCompile(`(?is)^\s*<code(\s[^>]*)?>(.*)</code>\s*$`)
+
+// highlightCode replaces the listings of known languages with highlighted
+// spans. Listings with markup of their own, like callouts, are kept.
+func highlightCode(content string, options CodeOptions) string {
+	return codeBlockReg.ReplaceAllStringFunc(content, func(block string) string {
+		match := codeBlockReg.FindStringSubmatch(block)
+		open, language, code := match[1], match[2], match[3]
+		if inner := codeWrapperReg.FindStringSubmatch(code); inner != nil {
+			code = inner[2]
+		}
+		if strings.Contains(code, "<") {
+			return block
+		}
+		lexer := lexers.Get(language)
+		if lexer == nil {
+			logrus.Debug("no highlighting for " + language)
+			return block
+		}
+		source := html.UnescapeString(code)
+		iterator, err := chroma.Coalesce(lexer).Tokenise(nil, source)
+		if err != nil {
+			logrus.Debug("keep listing: " + err.Error())
+			return block
+		}
+		tokens := iterator.Tokens()
+		// lexers end the last line with a newline the listing may not have
+		if n := len(tokens); n > 0 && !strings.HasSuffix(source, "\n") {
+			tokens[n-1].Value = strings.TrimSuffix(tokens[n-1].Value, "\n")
+		}
+		return addClass(open, "chroma") + formatCode(tokens, options.Wrap) + "</pre>"
+	})
+}
+
+// formatCode writes the tokens as spans with the chroma class names
+func formatCode(tokens []chroma.Token, wrap bool) string {
+	var out strings.Builder
+	for _, line := range chroma.SplitTokensIntoLines(tokens) {
+		long := false
+		if wrap {
+			length := 0
+			for _, token := range line {
+				length += utf8.RuneCountInString(token.Value)
+			}
+			long = length > codeWrapColumn
+		}
+		for _, token := range line {
+			text := html.EscapeString(token.Value)
+			if long {
+				text = wrapHints(text)
+			}
+			if class := tokenClass(token.Type); class != "" {
+				out.WriteString(`<span class="` + class + `">` + text + `</span>`)
+			} else {
+				out.WriteString(text)
+			}
+		}
+	}
+	return out.String()
+}
+
+// wrapHints lets escaped code break after separators
+func wrapHints(text string) string {
+	var out strings.Builder
+	for _, r := range text {
+		out.WriteRune(r)
+		switch r {
+		case '.', '/', ',', '(', ';':
+			out.WriteString("<wbr/>")
+		}
+	}
+	return out.String()
+}
+
+// tokenClass looks up the class of a token type like the chroma html
+// formatter, falling back to the parent type
+func tokenClass(t chroma.TokenType) string {
+	for ; t != 0; t = t.Parent() {
+		if class, ok := chroma.StandardTypes[t]; ok {
+			return class
+		}
+	}
+	return chroma.StandardTypes[t]
+}
+
+func addClass(tag string, class string) string {
+	if match := classAttrReg.FindStringSubmatch(tag); match != nil {
+		return strings.Replace(tag, match[0], ` class="`+strings.TrimSpace(match[1]+" "+class)+`"`, 1)
+	}
+	return strings.TrimSuffix(tag, ">") + ` class="` + class + `">`
+}
+
+// writeCodeCSS writes the theme of the highlighted listings
+func writeCodeCSS(w io.Writer, options CodeOptions) error {
+	style := styles.Get(codeThemes[options.Theme])
+	if _, err := io.WriteString(w, "\n/* code listings */\n"); err != nil {
+		return err
+	}
+	if err := chromahtml.New(chromahtml.WithClasses(true)).WriteCSS(w, style); err != nil {
+		return err
+	}
+	whiteSpace := "pre; overflow-x: auto"
+	if options.Wrap {
+		whiteSpace = "pre-wrap; overflow-wrap: break-word"
+	}
+	_, err := io.WriteString(w, "pre.chroma { color: "+codeColor(style)+"; padding: 0.5em; white-space: "+whiteSpace+"; }\n")
+	return err
+}
+
+// codeColor is the text colour of a listing, styles without one get black
+// or white so listings stay readable on a page with another colour
+func codeColor(style *chroma.Style) string {
+	background := style.Get(chroma.Background)
+	if background.Colour.IsSet() {
+		return background.Colour.String()
+	}
+	if background.Background.IsSet() && background.Background.Brightness() < 0.5 {
+		return "#ffffff"
+	}
+	return "#000000"
+}
@@ -0,0 +1,54 @@
+package ebook
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHighlightCode(t *testing.T) {
+	input := `<pre data-type="programlisting" data-code-language="go">func main() {
+	fmt.Println(&quot;hi &lt;3&quot;)
+}</pre>`
+	result := highlightCode(input, CodeOptions{Theme: "light"})
+	assert.Equal(t, `<pre data-type="programlisting" data-code-language="go" class="chroma"><span class="kd">func</span> <span class="nf">main</span><span class="p">()</span> <span class="p">{</span>
+	<span class="nx">fmt</span><span class="p">.</span><span class="nf">Println</span><span class="p">(</span><span class="s">&#34;hi &lt;3&#34;</span><span class="p">)</span>
+<span class="p">}</span></pre>`, result)
+}
+
+func TestHighlightCodeKeepsListings(t *testing.T) {
+	// unknown languages, callouts and listings without a language
+	for _, input := range []string{
+		`<pre data-code-language="klingon">qaStaH nuq</pre>`,
+		`<pre data-code-language="go">x := 1 <b>(1)</b></pre>`,
+		`<pre>plain</pre>`,
+	} {
+		assert.Equal(t, input, highlightCode(input, CodeOptions{Theme: "dark"}))
+	}
+}
+
+func TestHighlightCodeWrapHints(t *testing.T) {
+	input := `<pre class="programlisting" data-code-language="shell"><code>curl https://example.com/api/v1/books/9781491935675/chapters/ch01.html</code></pre>`
+	result := highlightCode(input, CodeOptions{Theme: "light", Wrap: true})
+	assert.Contains(t, result, `class="programlisting chroma"`)
+	assert.Contains(t, result, `example.<wbr/>com/<wbr/>api/<wbr/>`)
+
+	short := highlightCode(`<pre data-code-language="shell">ls /tmp</pre>`, CodeOptions{Theme: "light", Wrap: true})
+	assert.NotContains(t, short, "<wbr/>")
+}
+
+func TestWriteCodeCSS(t *testing.T) {
+	var light, dark bytes.Buffer
+	assert.NoError(t, writeCodeCSS(&light, CodeOptions{Theme: "light"}))
+	assert.NoError(t, writeCodeCSS(&dark, CodeOptions{Theme: "dark", Wrap: true}))
+
+	assert.Contains(t, light.String(), ".chroma .kd {")
+	assert.Contains(t, light.String(), "white-space: pre;")
+	assert.Contains(t, dark.String(), "pre.chroma { color: #f8f8f2;")
+	assert.Contains(t, dark.String(), "white-space: pre-wrap;")
+	assert.NotEqual(t, light.String(), dark.String())
+
+	assert.NoError(t, CheckCodeTheme("dark"))
+	assert.Error(t, CheckCodeTheme("solarized"))
+}
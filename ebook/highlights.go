@@ -0,0 +1,193 @@
+package ebook
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+	"time"
+
+	logrus "github.com/Sirupsen/logrus"
+)
+
+// Highlights are the passages a reader marked in one book
+type Highlights struct {
+	Title string `json:"title"`
+	// LastRead is the title of the chapter the reader stopped at
+	LastRead   string      `json:"last_read,omitempty"`
+	Highlights []Highlight `json:"highlights"`
+}
+
+// Highlight is one marked passage and the note about it
+type Highlight struct {
+	Chapter      string    `json:"chapter"`
+	ChapterTitle string    `json:"chapter_title,omitempty"`
+	Text         string    `json:"text"`
+	Note         string    `json:"note,omitempty"`
+	Created      time.Time `json:"created"`
+}
+
+// notesFile and notesId are the generated chapter listing the highlights
+const (
+	notesFile = "my-notes.html"
+	notesId   = "my-notes"
+)
+
+// SetHighlights marks the highlights in the chapters and adds a My Notes
+// chapter listing them
+func (e *Ebook) SetHighlights(highlights []Highlight) {
+	e.highlights = highlights
+}
+
+// WriteHighlightsMarkdown writes the highlights grouped by chapter, notes
+// follow the quote they belong to
+func WriteHighlightsMarkdown(w io.Writer, highlights Highlights) error {
+	var out strings.Builder
+	out.WriteString("# " + highlights.Title + "\n")
+	if highlights.LastRead != "" {
+		out.WriteString("\nLast read: " + highlights.LastRead + "\n")
+	}
+	chapter := ""
+	for _, highlight := range highlights.Highlights {
+		if title := highlight.title(); title != chapter {
+			chapter = title
+			out.WriteString("\n## " + title + "\n")
+		}
+		out.WriteString("\n> " + strings.Replace(strings.TrimSpace(highlight.Text), "\n", "\n> ", -1) + "\n")
+		if highlight.Note != "" {
+			out.WriteString("\n" + strings.TrimSpace(highlight.Note) + "\n")
+		}
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// WriteHighlightsJSON writes the highlights as indented json
+func WriteHighlightsJSON(w io.Writer, highlights Highlights) error {
+	if highlights.Highlights == nil {
+		highlights.Highlights = []Highlight{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(highlights)
+}
+
+func (h Highlight) title() string {
+	if h.ChapterTitle != "" {
+		return h.ChapterTitle
+	}
+	return h.Chapter
+}
+
+// markHighlight wraps the first occurrence of text outside a tag in a mark
+// with the given id. Passages spanning markup are not marked.
+func markHighlight(content string, text string, id string) (string, bool) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return content, false
+	}
+	minimal := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+	for _, candidate := range []string{minimal, html.EscapeString(text)} {
+		offset := 0
+		for {
+			index := strings.Index(content[offset:], candidate)
+			if index < 0 {
+				break
+			}
+			start := offset + index
+			if strings.LastIndex(content[:start], "<") <= strings.LastIndex(content[:start], ">") {
+				end := start + len(candidate)
+				return content[:start] + `<mark class="highlight" id="` + id + `">` + content[start:end] + "</mark>" + content[end:], true
+			}
+			offset = start + len(candidate)
+		}
+	}
+	return content, false
+}
+
+// markHighlights marks the highlights of each chapter, it returns the ids
+// of the marked ones by index
+func (e *Ebook) markHighlights() map[int]string {
+	marked := make(map[int]string)
+	for index, highlight := range e.highlights {
+		for i, chapter := range e.jsonBook.Chapters {
+			if chapter.Filename != highlight.Chapter {
+				continue
+			}
+			id := fmt.Sprintf("highlight-%d", index+1)
+			content, ok := markHighlight(chapter.Content, highlight.Text, id)
+			if !ok {
+				logrus.Debug("highlight " + id + " not found in " + chapter.Filename)
+				break
+			}
+			e.jsonBook.Chapters[i].Content = content
+			marked[index] = chapter.Filename + "#" + id
+			break
+		}
+	}
+	return marked
+}
+
+// addNotesChapter marks the highlights and appends the My Notes chapter,
+// highlights found in the text link back to it
+func (e *Ebook) addNotesChapter() {
+	if len(e.highlights) == 0 {
+		return
+	}
+	marked := e.markHighlights()
+
+	var out strings.Builder
+	out.WriteString("<section epub:type=\"chapter\" id=\"my-notes\">\n<h1>My Notes</h1>\n")
+	chapter := ""
+	for index, highlight := range e.highlights {
+		if title := highlight.title(); title != chapter {
+			chapter = title
+			out.WriteString("<h2>" + html.EscapeString(title) + "</h2>\n")
+		}
+		out.WriteString(fmt.Sprintf("<blockquote class=\"highlight\" id=\"note-%d\">\n<p>%s</p>\n", index+1, html.EscapeString(strings.TrimSpace(highlight.Text))))
+		if highlight.Note != "" {
+			out.WriteString("<p class=\"note\">" + html.EscapeString(strings.TrimSpace(highlight.Note)) + "</p>\n")
+		}
+		if link, ok := marked[index]; ok {
+			out.WriteString("<p><a href=\"" + link + "\">Go to the passage</a></p>\n")
+		}
+		out.WriteString("</blockquote>\n")
+	}
+	out.WriteString("</section>")
+
+	e.jsonBook.Chapters = append(e.jsonBook.Chapters, Chapter{
+		Id:       notesId,
+		Filename: e.notesFilename(),
+		Title:    "My Notes",
+		Order:    len(e.jsonBook.Chapters) + 1,
+		Content:  out.String(),
+	})
+}
+
+// notesFilename is the file of the My Notes chapter, numbered when a chapter
+// of the book has the name already
+func (e *Ebook) notesFilename() string {
+	base := strings.TrimSuffix(notesFile, ".html")
+	candidate := notesFile
+	for n := 2; e.chapterFileUsed(candidate); n++ {
+		candidate = fmt.Sprintf("%s-%d.html", base, n)
+	}
+	return candidate
+}
+
+// chapterFileUsed reports whether a chapter of the book is stored at name
+func (e *Ebook) chapterFileUsed(name string) bool {
+	for _, chapter := range e.jsonBook.Chapters {
+		if chapter.Filename == name {
+			return true
+		}
+	}
+	return false
+}
+
+// writeHighlightsCSS styles the marked passages
+func writeHighlightsCSS(w io.Writer) error {
+	_, err := io.WriteString(w, "\n/* highlights */\nmark.highlight { background-color: #fff3a0; color: inherit; }\nblockquote.highlight p.note { font-style: italic; }\n")
+	return err
+}
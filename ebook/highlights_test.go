@@ -0,0 +1,119 @@
+package ebook
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarkHighlight(t *testing.T) {
+	content := `<p><a title="Pods &amp; nodes">Pods &amp; nodes</a> run. Pods &amp; nodes scale.</p>`
+
+	out, ok := markHighlight(content, "Pods & nodes scale", "highlight-1")
+	assert.True(t, ok)
+	assert.Equal(t, `<p><a title="Pods &amp; nodes">Pods &amp; nodes</a> run. <mark class="highlight" id="highlight-1">Pods &amp; nodes scale</mark>.</p>`, out)
+
+	// the attribute value is skipped, the text is marked
+	out, ok = markHighlight(content, "Pods & nodes", "highlight-2")
+	assert.True(t, ok)
+	assert.Equal(t, `<p><a title="Pods &amp; nodes"><mark class="highlight" id="highlight-2">Pods &amp; nodes</mark></a> run. Pods &amp; nodes scale.</p>`, out)
+
+	// passages spanning markup are not found
+	_, ok = markHighlight(content, "nodes run", "highlight-3")
+	assert.False(t, ok)
+}
+
+func TestWriteHighlights(t *testing.T) {
+	highlights := Highlights{
+		Title:    "Kubernetes",
+		LastRead: "Services",
+		Highlights: []Highlight{
+			{Chapter: "ch01.html", ChapterTitle: "Pods", Text: "A pod is a group", Note: "remember this"},
+			{Chapter: "ch01.html", ChapterTitle: "Pods", Text: "Pods are mortal"},
+			{Chapter: "ch02.html", Text: "Services route\ntraffic"},
+		},
+	}
+
+	var markdown bytes.Buffer
+	assert.NoError(t, WriteHighlightsMarkdown(&markdown, highlights))
+	assert.Equal(t, `# Kubernetes
+
+Last read: Services
+
+## Pods
+
+> A pod is a group
+
+remember this
+
+> Pods are mortal
+
+## ch02.html
+
+> Services route
+> traffic
+`, markdown.String())
+
+	var out bytes.Buffer
+	assert.NoError(t, WriteHighlightsJSON(&out, Highlights{Title: "Kubernetes"}))
+	assert.JSONEq(t, `{"title": "Kubernetes", "highlights": []}`, out.String())
+}
+
+func TestWriteNotesChapter(t *testing.T) {
+	path := writeTestBook(t, JsonBook{
+		Title:    "Kubernetes",
+		Uuid:     "9781491935675",
+		Language: "en",
+		Chapters: []Chapter{
+			{Id: "ch01", Filename: "ch01.html", Order: 1, Title: "Pods", Content: "<p>A pod is a group of containers.</p>"},
+		},
+	}, func(e *Ebook) {
+		e.SetHighlights([]Highlight{
+			{Chapter: "ch01.html", ChapterTitle: "Pods", Text: "a group of containers", Note: "Pods & containers"},
+			{Chapter: "ch01.html", ChapterTitle: "Pods", Text: "not in the text"},
+		})
+	})
+	defer os.RemoveAll(filepath.Dir(path))
+
+	messages, err := Validate(path)
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+
+	assert.Contains(t, readEpubFile(t, path, "OEBPS/ch01.html"), `A pod is <mark class="highlight" id="highlight-1">a group of containers</mark>.`)
+	notes := readEpubFile(t, path, "OEBPS/my-notes.html")
+	assert.Contains(t, notes, `<p class="note">Pods &amp; containers</p>`)
+	assert.Contains(t, notes, `<a href="ch01.html#highlight-1">`)
+	assert.Equal(t, 1, bytes.Count([]byte(notes), []byte("Go to the passage")))
+	assert.Contains(t, readEpubFile(t, path, "OEBPS/content.opf"), `href="my-notes.html"`)
+	assert.Contains(t, readEpubFile(t, path, "OEBPS/style.css"), "mark.highlight")
+}
+
+func TestNotesChapterAvoidsChapterFilenames(t *testing.T) {
+	path := writeTestBook(t, JsonBook{
+		Title:    "Kubernetes",
+		Uuid:     "9781491935675",
+		Language: "en",
+		Chapters: []Chapter{
+			{Id: "ch01", Filename: "my-notes.html", Order: 1, Title: "Pods", Content: "<p>A pod is a group of containers.</p>"},
+		},
+	}, func(e *Ebook) {
+		e.SetHighlights([]Highlight{
+			{Chapter: "my-notes.html", ChapterTitle: "Pods", Text: "a group of containers"},
+		})
+	})
+	defer os.RemoveAll(filepath.Dir(path))
+
+	messages, err := Validate(path)
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+
+	assert.Contains(t, readEpubFile(t, path, "OEBPS/my-notes.html"), "A pod is")
+	notes := readEpubFile(t, path, "OEBPS/my-notes-2.html")
+	assert.Contains(t, notes, `<a href="my-notes.html#highlight-1">`)
+	opf := readEpubFile(t, path, "OEBPS/content.opf")
+	assert.Contains(t, opf, `href="my-notes.html"`)
+	assert.Contains(t, opf, `href="my-notes-2.html"`)
+}
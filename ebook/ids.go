@@ -0,0 +1,50 @@
+package ebook
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// reservedIds are the ids content.opf gives its own metadata and items
+var reservedIds = map[string]bool{
+	"BookId":          true,
+	"meta-identifier": true,
+	"meta-title":      true,
+	"meta-language":   true,
+	"ncx":             true,
+	"css":             true,
+	"core-css":        true,
+	"user-css":        true,
+	"image_cover":     true,
+	"cover-page":      true,
+	notesId:           true,
+}
+
+// numbered ids of the authors and images in content.opf
+var reservedIdReg = regexp.MustCompile(`^(creator|image_)[0-9]+$`)
+
+// isReservedId reports whether content.opf already uses id, chapters must
+// not take it
+func isReservedId(id string) bool {
+	return reservedIds[id] || reservedIdReg.MatchString(id)
+}
+
+// uniqueChapterIds renames chapters whose id is reserved or taken by an
+// earlier chapter, e.g. in books read with Open. Chapters without id are
+// named after their position.
+func (e *Ebook) uniqueChapterIds() {
+	used := make(map[string]bool)
+	for index, chapter := range e.jsonBook.Chapters {
+		base := chapter.Id
+		if base == "" {
+			base = fmt.Sprintf("chapter-%d", index+1)
+		}
+		id := base
+		for i := 2; used[id] || isReservedId(id); i++ {
+			id = base + "-" + strconv.Itoa(i)
+		}
+		used[id] = true
+		e.jsonBook.Chapters[index].Id = id
+	}
+}
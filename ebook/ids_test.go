@@ -0,0 +1,21 @@
+package ebook
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUniqueChapterIds(t *testing.T) {
+	assert.True(t, isReservedId("image_12"))
+	assert.True(t, isReservedId("creator0"))
+	assert.False(t, isReservedId("image_cover_art"))
+
+	e := &Ebook{jsonBook: JsonBook{Chapters: []Chapter{{Id: "ch01"}, {Id: "ch01"}, {Id: "image_cover"}, {Id: "my-notes"}, {Id: "ncx"}, {Id: "image_1"}, {}, {Id: "chapter-8"}}}}
+	e.uniqueChapterIds()
+	var ids []string
+	for _, chapter := range e.jsonBook.Chapters {
+		ids = append(ids, chapter.Id)
+	}
+	assert.Equal(t, []string{"ch01", "ch01-2", "image_cover-2", "my-notes-2", "ncx-2", "image_1-2", "chapter-7", "chapter-8"}, ids)
+}
@@ -0,0 +1,135 @@
+package ebook
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kkc/safari-books-downloader/utils"
+
+	logrus "github.com/Sirupsen/logrus"
+)
+
+// size of the placeholder for a missing image
+const (
+	placeholderWidth  = 400
+	placeholderHeight = 100
+)
+
+// SetConcurrency sets how many images are downloaded at once
+func (e *Ebook) SetConcurrency(concurrency int) {
+	if concurrency > 0 {
+		e.concurrency = concurrency
+	}
+}
+
+// downloadImages fetches the chapter images with a pool of workers. Images
+// that cannot be fetched are logged and replaced by a placeholder, so one
+// missing image does not lose the book.
+func (e *Ebook) downloadImages() {
+	e.collectImages()
+	images := e.images
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var done int32
+	var missing int32
+	for worker := 0; worker < e.concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				image := images[index]
+				if err := e.downloadImage(image); err != nil {
+					atomic.AddInt32(&missing, 1)
+					logrus.WithFields(logrus.Fields{
+						"Image": image.BaseUrl + image.File,
+					}).Warn("using a placeholder for a missing image: " + err.Error())
+					check(e.writePlaceholder(image))
+				}
+				current := atomic.AddInt32(&done, 1)
+				e.progress.Report(utils.ProgressEvent{Type: utils.ImageDone, Current: int(current), Total: len(images)})
+			}
+		}()
+	}
+	for index := range images {
+		jobs <- index
+	}
+	close(jobs)
+	wg.Wait()
+
+	if missing > 0 {
+		logrus.WithFields(logrus.Fields{
+			"Missing": missing,
+			"Images":  len(images),
+		}).Warn("some images could not be downloaded")
+	}
+}
+
+// downloadImage fetches one image and checks that it is one
+func (e *Ebook) downloadImage(image ImageToFetch) error {
+	file := e.tempBookPath + "/OEBPS/" + image.Path
+	if image.Unchanged {
+		if _, err := os.Stat(file); err == nil {
+			logrus.Debug("reuse image " + image.Path)
+			return nil
+		}
+	}
+
+	data, err := e.fetcher.FetchAsset(image.BaseUrl + image.File)
+	if err != nil {
+		return err
+	}
+	if !isImageData(data, image.Media) {
+		return errors.New("the response is " + http.DetectContentType(data) + ", not " + image.Media)
+	}
+	e.progress.Report(utils.ProgressEvent{Type: utils.BytesDownloaded, Bytes: int64(len(data))})
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+// isImageData sniffs the content, svg is text so it is checked by its tag
+func isImageData(data []byte, media string) bool {
+	if media == "image/svg+xml" {
+		return bytes.Contains(data, []byte("<svg"))
+	}
+	return strings.HasPrefix(http.DetectContentType(data), "image/")
+}
+
+// writePlaceholder stores a gray box in the format the manifest declares
+func (e *Ebook) writePlaceholder(target ImageToFetch) error {
+	file := e.tempBookPath + "/OEBPS/" + target.Path
+	if target.Media == "image/svg+xml" {
+		svg := `<svg xmlns="http://www.w3.org/2000/svg" width="400" height="100"><rect width="100%" height="100%" fill="#ddd"/></svg>`
+		return ioutil.WriteFile(file, []byte(svg), 0644)
+	}
+
+	img := image.NewPaletted(image.Rect(0, 0, placeholderWidth, placeholderHeight), color.Palette{color.Gray{0xdd}, color.Gray{0x99}})
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.Gray{0x99}}, image.Point{}, draw.Src)
+	draw.Draw(img, img.Bounds().Inset(2), &image.Uniform{color.Gray{0xdd}}, image.Point{}, draw.Src)
+
+	var out bytes.Buffer
+	var err error
+	switch target.Media {
+	case "image/jpeg":
+		err = jpeg.Encode(&out, img, nil)
+	case "image/gif":
+		err = gif.Encode(&out, img, nil)
+	default:
+		err = png.Encode(&out, img)
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, out.Bytes(), 0644)
+}
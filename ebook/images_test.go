@@ -0,0 +1,77 @@
+package ebook
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/kkc/safari-books-downloader/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingFetcher records the urls it was asked for
+type countingFetcher struct {
+	fakeFetcher
+	sync.Mutex
+	urls []string
+}
+
+func (f *countingFetcher) FetchAsset(url string) ([]byte, error) {
+	f.Lock()
+	f.urls = append(f.urls, url)
+	f.Unlock()
+	return f.fakeFetcher.FetchAsset(url)
+}
+
+func TestDownloadImagesUsesPlaceholders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "images")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	png := encodePNG(t, screenshot(4, 4))
+	fetcher := &countingFetcher{fakeFetcher: fakeFetcher{
+		"https://example.com/a.png":     png,
+		"https://example.com/error.jpg": []byte("<html>rate limited</html>"),
+	}}
+	e := &Ebook{
+		jsonBook: JsonBook{Chapters: []Chapter{
+			{AssetBaseURL: "https://example.com/", Images: []string{"a.png", "error.jpg"}},
+			{AssetBaseURL: "https://example.com/", Images: []string{"a.png", "missing.gif"}},
+		}},
+		tempBookPath: dir,
+		fetcher:      fetcher,
+		concurrency:  3,
+		progress:     utils.NopProgress,
+	}
+	prepareFolder(dir)
+	e.downloadImages()
+
+	assert.Len(t, e.images, 3)
+	assert.ElementsMatch(t, []string{
+		"https://example.com/a.png",
+		"https://example.com/error.jpg",
+		"https://example.com/missing.gif",
+	}, fetcher.urls)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "OEBPS", "images", "a.png"))
+	assert.NoError(t, err)
+	assert.Equal(t, png, data)
+	for name, format := range map[string]string{"error.jpg": "jpeg", "missing.gif": "gif"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "OEBPS", "images", name))
+		assert.NoError(t, err)
+		config, detected, err := image.DecodeConfig(bytes.NewReader(data))
+		assert.NoError(t, err)
+		assert.Equal(t, format, detected)
+		assert.Equal(t, placeholderWidth, config.Width)
+	}
+}
+
+func TestIsImageData(t *testing.T) {
+	assert.True(t, isImageData(encodePNG(t, screenshot(1, 1)), "image/png"))
+	assert.False(t, isImageData([]byte("<!DOCTYPE html><html></html>"), "image/png"))
+	assert.True(t, isImageData([]byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"/>`), "image/svg+xml"))
+}
@@ -0,0 +1,583 @@
+package ebook
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	logrus "github.com/Sirupsen/logrus"
+)
+
+// MathML fallbacks for readers without MathML support
+const (
+	// MathFallbackNone keeps the MathML
+	MathFallbackNone = ""
+	// MathFallbackAltText replaces the MathML with its alt text
+	MathFallbackAltText = "alttext"
+	// MathFallbackSVG renders the MathML to inline SVG
+	MathFallbackSVG = "svg"
+)
+
+// MathFallbacks lists the fallback names
+func MathFallbacks() []string {
+	return []string{MathFallbackAltText, MathFallbackSVG}
+}
+
+// SetMathFallback replaces the MathML of the chapters, MathFallbackNone
+// keeps it
+func (e *Ebook) SetMathFallback(fallback string) {
+	e.mathFallback = fallback
+}
+
+var svgElementReg = regexp.MustCompile(`<(\w+:)?svg[\s/>]`)
+var mathElementReg = regexp.MustCompile(`<(\w+:)?math[\s/>]`)
+var mathBlockReg = regexp.MustCompile(`(?s)<(?:\w+:)?math[\s>].*?</(?:\w+:)?math>`)
+
+// chapterProperties returns the manifest properties for the inline SVG and
+// MathML of a chapter
+func chapterProperties(content string) string {
+	var properties []string
+	if mathElementReg.MatchString(content) {
+		properties = append(properties, "mathml")
+	}
+	if svgElementReg.MatchString(content) {
+		properties = append(properties, "svg")
+	}
+	return strings.Join(properties, " ")
+}
+
+// replaceMath applies the math fallback to the chapter content, MathML that
+// does not parse is kept
+func (e *Ebook) replaceMath(content string) string {
+	if e.mathFallback == MathFallbackNone {
+		return content
+	}
+	return mathBlockReg.ReplaceAllStringFunc(content, func(fragment string) string {
+		root, err := parseMath(fragment)
+		if err != nil {
+			logrus.Debug("keep MathML: " + err.Error())
+			return fragment
+		}
+		label := root.attrs["alttext"]
+		if label == "" {
+			label = strings.Join(strings.Fields(root.linear()), " ")
+		}
+		if e.mathFallback == MathFallbackSVG {
+			return renderMath(root, label)
+		}
+		return `<span class="math">` + html.EscapeString(label) + `</span>`
+	})
+}
+
+// mathNode is a MathML element, text is only kept for token elements
+type mathNode struct {
+	name     string
+	attrs    map[string]string
+	text     string
+	children []*mathNode
+}
+
+// parseMath reads one math element, namespace prefixes are dropped
+func parseMath(fragment string) (*mathNode, error) {
+	decoder := xml.NewDecoder(strings.NewReader(fragment))
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+
+	var stack []*mathNode
+	var root *mathNode
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &mathNode{name: t.Name.Local, attrs: make(map[string]string)}
+			for _, attr := range t.Attr {
+				node.attrs[attr.Name.Local] = attr.Value
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, node)
+			} else if root == nil {
+				root = node
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += string(t)
+			}
+		}
+	}
+	if root == nil || root.name != "math" {
+		return nil, errors.New("no math element")
+	}
+	return root, nil
+}
+
+func (n *mathNode) isToken() bool {
+	switch n.name {
+	case "mi", "mn", "mo", "mtext", "ms":
+		return true
+	}
+	return false
+}
+
+func (n *mathNode) tokenText() string {
+	return strings.TrimSpace(n.text)
+}
+
+// child returns the nth child or an empty row
+func (n *mathNode) child(index int) *mathNode {
+	if index < len(n.children) {
+		return n.children[index]
+	}
+	return &mathNode{name: "mrow"}
+}
+
+// spacedOperators get spaces around them in the linear form
+var spacedOperators = map[string]bool{
+	"=": true, "+": true, "-": true, "−": true, "±": true, "×": true, "·": true,
+	"<": true, ">": true, "≤": true, "≥": true, "≠": true, "≈": true, "→": true,
+}
+
+// linear writes the math as plain text like a^2 + (a+b)/c
+func (n *mathNode) linear() string {
+	if n.isToken() {
+		if n.name == "mo" && spacedOperators[n.tokenText()] {
+			return " " + n.tokenText() + " "
+		}
+		return n.tokenText()
+	}
+
+	group := func(node *mathNode) string {
+		text := strings.TrimSpace(node.linear())
+		if utf8.RuneCountInString(text) > 1 {
+			return "(" + text + ")"
+		}
+		return text
+	}
+	switch n.name {
+	case "mspace":
+		return " "
+	case "annotation", "annotation-xml", "mphantom":
+		return ""
+	case "semantics", "maction":
+		return n.child(0).linear()
+	case "mfrac":
+		return group(n.child(0)) + "/" + group(n.child(1))
+	case "msup", "mover":
+		return n.child(0).linear() + "^" + group(n.child(1))
+	case "msub", "munder":
+		return n.child(0).linear() + "_" + group(n.child(1))
+	case "msubsup", "munderover":
+		return n.child(0).linear() + "_" + group(n.child(1)) + "^" + group(n.child(2))
+	case "msqrt":
+		return "√" + group(&mathNode{name: "mrow", children: n.children})
+	case "mroot":
+		return "root(" + strings.TrimSpace(n.child(1).linear()) + ", " + strings.TrimSpace(n.child(0).linear()) + ")"
+	case "mfenced":
+		open, close, _ := n.fences()
+		var out strings.Builder
+		out.WriteString(open)
+		for index, child := range n.children {
+			if index > 0 {
+				out.WriteString(n.separator(index) + " ")
+			}
+			out.WriteString(strings.TrimSpace(child.linear()))
+		}
+		return out.String() + close
+	case "mtable":
+		var rows []string
+		for _, row := range n.children {
+			var cells []string
+			for _, cell := range row.children {
+				cells = append(cells, strings.TrimSpace(cell.linear()))
+			}
+			rows = append(rows, strings.Join(cells, ", "))
+		}
+		return "[" + strings.Join(rows, "; ") + "]"
+	}
+
+	var out strings.Builder
+	for _, child := range n.children {
+		out.WriteString(child.linear())
+	}
+	return out.String()
+}
+
+// fences returns the open and close strings and separators of mfenced
+func (n *mathNode) fences() (string, string, string) {
+	open, close, separators := "(", ")", ","
+	if value, ok := n.attrs["open"]; ok {
+		open = value
+	}
+	if value, ok := n.attrs["close"]; ok {
+		close = value
+	}
+	if value, ok := n.attrs["separators"]; ok {
+		separators = strings.Join(strings.Fields(value), "")
+	}
+	if separators == "" {
+		separators = " "
+	}
+	return open, close, separators
+}
+
+// separator returns the separator of mfenced before child index, the last
+// separator is repeated for the remaining children
+func (n *mathNode) separator(index int) string {
+	_, _, separators := n.fences()
+	runes := []rune(separators)
+	if index-1 < len(runes) {
+		return string(runes[index-1])
+	}
+	return string(runes[len(runes)-1])
+}
+
+// mathFontSize is the font size in pixels of rendered math
+const mathFontSize = 16
+
+// scripts, indexes and limits are drawn smaller
+const mathScriptScale = 0.7
+
+// mathBox is the layout of a MathML element, ascent and descent are
+// measured from the baseline and draw writes SVG at the baseline y
+type mathBox struct {
+	width, ascent, descent float64
+	draw                   func(out *strings.Builder, x float64, y float64)
+}
+
+func emptyBox() mathBox {
+	return mathBox{draw: func(*strings.Builder, float64, float64) {}}
+}
+
+// renderMath lays the math out with estimated glyph widths and writes it as
+// an inline svg image
+func renderMath(root *mathNode, label string) string {
+	const margin = 2
+	box := layoutMath(root, mathFontSize)
+	style := fmt.Sprintf("vertical-align: -%spx", svgNumber(box.descent+margin))
+	if root.attrs["display"] == "block" {
+		style = "display: block; margin: 0.5em auto"
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, `<svg xmlns="http://www.w3.org/2000/svg" class="math" role="img" aria-label="%s" width="%s" height="%s" viewBox="0 0 %s %s" style="%s">`,
+		html.EscapeString(label),
+		svgNumber(box.width+2*margin), svgNumber(box.ascent+box.descent+2*margin),
+		svgNumber(box.width+2*margin), svgNumber(box.ascent+box.descent+2*margin),
+		style)
+	fmt.Fprintf(&out, `<title>%s</title><g font-family="serif" fill="currentColor">`, html.EscapeString(label))
+	box.draw(&out, margin, margin+box.ascent)
+	out.WriteString(`</g></svg>`)
+	return out.String()
+}
+
+func layoutMath(n *mathNode, size float64) mathBox {
+	switch n.name {
+	case "mi":
+		// single letter identifiers are italic unless asked otherwise
+		italic := utf8.RuneCountInString(n.tokenText()) == 1 && n.attrs["mathvariant"] != "normal"
+		return textBox(n.tokenText(), size, italic, 0)
+	case "mn", "mtext", "ms":
+		return textBox(n.tokenText(), size, false, 0)
+	case "mo":
+		padding := 0.0
+		if spacedOperators[n.tokenText()] {
+			padding = 0.2 * size
+		}
+		return textBox(n.tokenText(), size, false, padding)
+	case "mspace":
+		box := emptyBox()
+		if width := n.attrs["width"]; strings.HasSuffix(width, "em") {
+			if em, err := strconv.ParseFloat(strings.TrimSuffix(width, "em"), 64); err == nil {
+				box.width = em * size
+			}
+		}
+		return box
+	case "annotation", "annotation-xml":
+		return emptyBox()
+	case "mphantom":
+		box := rowBox(layoutChildren(n.children, size))
+		box.draw = emptyBox().draw
+		return box
+	case "semantics", "maction":
+		return layoutMath(n.child(0), size)
+	case "msup":
+		sup := layoutMath(n.child(1), size*mathScriptScale)
+		return scriptBox(layoutMath(n.child(0), size), nil, &sup, size)
+	case "msub":
+		sub := layoutMath(n.child(1), size*mathScriptScale)
+		return scriptBox(layoutMath(n.child(0), size), &sub, nil, size)
+	case "msubsup":
+		sub := layoutMath(n.child(1), size*mathScriptScale)
+		sup := layoutMath(n.child(2), size*mathScriptScale)
+		return scriptBox(layoutMath(n.child(0), size), &sub, &sup, size)
+	case "mover":
+		over := layoutMath(n.child(1), size*mathScriptScale)
+		return stackBox(layoutMath(n.child(0), size), nil, &over, size)
+	case "munder":
+		under := layoutMath(n.child(1), size*mathScriptScale)
+		return stackBox(layoutMath(n.child(0), size), &under, nil, size)
+	case "munderover":
+		under := layoutMath(n.child(1), size*mathScriptScale)
+		over := layoutMath(n.child(2), size*mathScriptScale)
+		return stackBox(layoutMath(n.child(0), size), &under, &over, size)
+	case "mfrac":
+		return fractionBox(layoutMath(n.child(0), size), layoutMath(n.child(1), size), n.attrs["linethickness"] != "0", size)
+	case "msqrt":
+		return rootBox(rowBox(layoutChildren(n.children, size)), nil, size)
+	case "mroot":
+		index := layoutMath(n.child(1), size*mathScriptScale*mathScriptScale)
+		return rootBox(layoutMath(n.child(0), size), &index, size)
+	case "mfenced":
+		open, close, _ := n.fences()
+		boxes := []mathBox{textBox(open, size, false, 0)}
+		for index, child := range n.children {
+			if index > 0 {
+				boxes = append(boxes, textBox(n.separator(index), size, false, 0))
+			}
+			boxes = append(boxes, layoutMath(child, size))
+		}
+		return rowBox(append(boxes, textBox(close, size, false, 0)))
+	case "mtable":
+		return tableBox(n, size)
+	}
+	if len(n.children) == 0 && n.tokenText() != "" {
+		return textBox(n.tokenText(), size, false, 0)
+	}
+	return rowBox(layoutChildren(n.children, size))
+}
+
+func layoutChildren(children []*mathNode, size float64) []mathBox {
+	boxes := make([]mathBox, 0, len(children))
+	for _, child := range children {
+		boxes = append(boxes, layoutMath(child, size))
+	}
+	return boxes
+}
+
+// textBox estimates the width of text, serif glyphs are about 0.6em wide
+func textBox(text string, size float64, italic bool, padding float64) mathBox {
+	style := ""
+	if italic {
+		style = ` font-style="italic"`
+	}
+	return mathBox{
+		width:   float64(utf8.RuneCountInString(text))*0.6*size + 2*padding,
+		ascent:  0.75 * size,
+		descent: 0.25 * size,
+		draw: func(out *strings.Builder, x float64, y float64) {
+			fmt.Fprintf(out, `<text x="%s" y="%s" font-size="%s"%s>%s</text>`,
+				svgNumber(x+padding), svgNumber(y), svgNumber(size), style, html.EscapeString(text))
+		},
+	}
+}
+
+func rowBox(boxes []mathBox) mathBox {
+	row := mathBox{}
+	for _, box := range boxes {
+		row.width += box.width
+		row.ascent = maxFloat(row.ascent, box.ascent)
+		row.descent = maxFloat(row.descent, box.descent)
+	}
+	row.draw = func(out *strings.Builder, x float64, y float64) {
+		for _, box := range boxes {
+			box.draw(out, x, y)
+			x += box.width
+		}
+	}
+	return row
+}
+
+// scriptBox places sub and superscripts after the base
+func scriptBox(base mathBox, sub *mathBox, sup *mathBox, size float64) mathBox {
+	supShift, subShift := 0.45*size, 0.25*size
+	box := base
+	scriptWidth := 0.0
+	if sup != nil {
+		scriptWidth = sup.width
+		box.ascent = maxFloat(box.ascent, sup.ascent+supShift)
+		box.descent = maxFloat(box.descent, sup.descent-supShift)
+	}
+	if sub != nil {
+		scriptWidth = maxFloat(scriptWidth, sub.width)
+		box.ascent = maxFloat(box.ascent, sub.ascent-subShift)
+		box.descent = maxFloat(box.descent, sub.descent+subShift)
+	}
+	box.width = base.width + scriptWidth
+	box.draw = func(out *strings.Builder, x float64, y float64) {
+		base.draw(out, x, y)
+		if sup != nil {
+			sup.draw(out, x+base.width, y-supShift)
+		}
+		if sub != nil {
+			sub.draw(out, x+base.width, y+subShift)
+		}
+	}
+	return box
+}
+
+// stackBox centers limits and accents above and below the base
+func stackBox(base mathBox, under *mathBox, over *mathBox, size float64) mathBox {
+	gap := 0.1 * size
+	box := base
+	if over != nil {
+		box.width = maxFloat(box.width, over.width)
+		box.ascent += gap + over.descent + over.ascent
+	}
+	if under != nil {
+		box.width = maxFloat(box.width, under.width)
+		box.descent += gap + under.ascent + under.descent
+	}
+	width := box.width
+	box.draw = func(out *strings.Builder, x float64, y float64) {
+		base.draw(out, x+(width-base.width)/2, y)
+		if over != nil {
+			over.draw(out, x+(width-over.width)/2, y-base.ascent-gap-over.descent)
+		}
+		if under != nil {
+			under.draw(out, x+(width-under.width)/2, y+base.descent+gap+under.ascent)
+		}
+	}
+	return box
+}
+
+// fractionBox centers the fraction bar on the math axis
+func fractionBox(numerator mathBox, denominator mathBox, bar bool, size float64) mathBox {
+	axis, gap, padding := 0.3*size, 0.15*size, 0.1*size
+	width := maxFloat(numerator.width, denominator.width) + 2*padding
+	return mathBox{
+		width:   width,
+		ascent:  axis + gap + numerator.descent + numerator.ascent,
+		descent: denominator.ascent + denominator.descent + gap - axis,
+		draw: func(out *strings.Builder, x float64, y float64) {
+			numerator.draw(out, x+(width-numerator.width)/2, y-axis-gap-numerator.descent)
+			denominator.draw(out, x+(width-denominator.width)/2, y-axis+gap+denominator.ascent)
+			if bar {
+				fmt.Fprintf(out, `<line x1="%s" y1="%s" x2="%s" y2="%s" stroke="currentColor" stroke-width="%s" />`,
+					svgNumber(x+padding/2), svgNumber(y-axis), svgNumber(x+width-padding/2), svgNumber(y-axis), svgNumber(0.06*size))
+			}
+		},
+	}
+}
+
+// rootBox draws a radical sign over the radicand with an optional index
+func rootBox(radicand mathBox, index *mathBox, size float64) mathBox {
+	sign, over := 0.6*size, 0.15*size
+	offset := 0.0
+	if index != nil {
+		offset = maxFloat(0, index.width-0.3*size)
+	}
+	top := radicand.ascent + over
+	box := mathBox{
+		width:   offset + sign + radicand.width + 0.1*size,
+		ascent:  top + 0.05*size,
+		descent: radicand.descent,
+	}
+	if index != nil {
+		box.ascent = maxFloat(box.ascent, 0.35*size+index.descent+index.ascent)
+	}
+	width := box.width
+	box.draw = func(out *strings.Builder, x float64, y float64) {
+		if index != nil {
+			index.draw(out, x, y-0.35*size-index.descent)
+		}
+		left := x + offset
+		fmt.Fprintf(out, `<path d="M%s %s L%s %s L%s %s L%s %s" fill="none" stroke="currentColor" stroke-width="%s" />`,
+			svgNumber(left), svgNumber(y-0.3*size),
+			svgNumber(left+0.25*size), svgNumber(y+radicand.descent),
+			svgNumber(left+sign-0.05*size), svgNumber(y-top),
+			svgNumber(x+width), svgNumber(y-top),
+			svgNumber(0.06*size))
+		radicand.draw(out, left+sign, y)
+	}
+	return box
+}
+
+// tableBox lays out mtable rows and columns centered on the math axis
+func tableBox(n *mathNode, size float64) mathBox {
+	columnGap, rowGap, axis := 0.8*size, 0.3*size, 0.3*size
+	var cells [][]mathBox
+	var widths []float64
+	for _, row := range n.children {
+		boxes := layoutChildren(row.children, size)
+		for index, box := range boxes {
+			if index == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[index] = maxFloat(widths[index], box.width)
+		}
+		cells = append(cells, boxes)
+	}
+
+	ascents := make([]float64, len(cells))
+	descents := make([]float64, len(cells))
+	height := 0.0
+	for index, row := range cells {
+		for _, box := range row {
+			ascents[index] = maxFloat(ascents[index], box.ascent)
+			descents[index] = maxFloat(descents[index], box.descent)
+		}
+		if index > 0 {
+			height += rowGap
+		}
+		height += ascents[index] + descents[index]
+	}
+	width := 0.0
+	for index, w := range widths {
+		if index > 0 {
+			width += columnGap
+		}
+		width += w
+	}
+
+	return mathBox{
+		width:   width,
+		ascent:  height/2 + axis,
+		descent: height/2 - axis,
+		draw: func(out *strings.Builder, x float64, y float64) {
+			top := y - height/2 - axis
+			for index, row := range cells {
+				baseline := top + ascents[index]
+				left := x
+				for column, box := range row {
+					box.draw(out, left+(widths[column]-box.width)/2, baseline)
+					left += widths[column] + columnGap
+				}
+				top = baseline + descents[index] + rowGap
+			}
+		},
+	}
+}
+
+func maxFloat(a float64, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// svgNumber formats a coordinate with at most two decimals
+func svgNumber(v float64) string {
+	s := strconv.FormatFloat(v, 'f', 2, 64)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "-0" || s == "" {
+		return "0"
+	}
+	return s
+}
@@ -0,0 +1,161 @@
+package ebook
+
+import (
+	"encoding/xml"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const quadratic = `<math xmlns="http://www.w3.org/1998/Math/MathML"><mi>x</mi><mo>=</mo><mfrac><mrow><mo>-</mo><mi>b</mi><mo>±</mo><msqrt><msup><mi>b</mi><mn>2</mn></msup><mo>-</mo><mn>4</mn><mi>a</mi><mi>c</mi></msqrt></mrow><mrow><mn>2</mn><mi>a</mi></mrow></mfrac></math>`
+
+func TestChapterProperties(t *testing.T) {
+	assert.Equal(t, "", chapterProperties(`<p>mathematics and svgs</p>`))
+	assert.Equal(t, "mathml", chapterProperties(`<p>`+quadratic+`</p>`))
+	assert.Equal(t, "svg", chapterProperties(`<svg xmlns="http://www.w3.org/2000/svg"><circle r="1"/></svg>`))
+	assert.Equal(t, "mathml svg", chapterProperties(`<m:math><m:mi>x</m:mi></m:math><svg:svg/>`))
+}
+
+func TestPurifyHTMLKeepsSVG(t *testing.T) {
+	e := &Ebook{}
+	input := `<svg xmlns="http://www.w3.org/2000/svg"><image href="a.png" width="10"/><rect width="1"/></svg><br class="x"><hr /><img src="a.png">`
+	assert.Equal(t, `<svg xmlns="http://www.w3.org/2000/svg"><image href="a.png" width="10"/><rect width="1"/></svg><br class="x"/><hr/><img src="a.png" />`, e.purifyHTML(input))
+}
+
+func TestMathFallbackAltText(t *testing.T) {
+	e := &Ebook{mathFallback: MathFallbackAltText}
+	assert.Equal(t, `<p><span class="math">x = (- b ± √(b^2 - 4ac))/(2a)</span></p>`, e.replaceMath(`<p>`+quadratic+`</p>`))
+	assert.Equal(t, `<span class="math">E equals m c squared</span>`, e.replaceMath(`<math alttext="E equals m c squared"><mi>E</mi></math>`))
+
+	// broken MathML is kept
+	broken := `<math><mi>x</mo></math>`
+	assert.Equal(t, broken, e.replaceMath(broken))
+}
+
+func TestMathFallbackSVG(t *testing.T) {
+	e := &Ebook{mathFallback: MathFallbackSVG}
+	result := e.replaceMath(`<p>` + quadratic + `</p>`)
+	assert.NotContains(t, result, "<math")
+	assert.Contains(t, result, `role="img" aria-label="x = (- b ± √(b^2 - 4ac))/(2a)"`)
+	assert.Contains(t, result, `font-style="italic">x</text>`)
+	assert.Contains(t, result, `<line `)
+	assert.Contains(t, result, `<path `)
+	assert.Equal(t, "svg", chapterProperties(result))
+
+	decoder := xml.NewDecoder(strings.NewReader(result))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			break
+		}
+	}
+}
+
+func TestWrittenBookDeclaresMathAndSVG(t *testing.T) {
+	path := writeTestBook(t, JsonBook{
+		Title:    "Calculus",
+		Uuid:     "9780000000001",
+		Language: "en",
+		Chapters: []Chapter{
+			{Id: "ch01", Filename: "ch01.html", Order: 1, Title: "One", Content: `<p>` + quadratic + `</p><svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><rect width="10" height="10"/></svg>`},
+			{Id: "ch02", Filename: "ch02.html", Order: 2, Title: "Two", Content: `<p>prose</p>`},
+		},
+	})
+	defer os.RemoveAll(filepath.Dir(path))
+
+	messages, err := Validate(path)
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+
+	book, err := Open(path)
+	if assert.NoError(t, err) && assert.Len(t, book.Chapters, 2) {
+		assert.Equal(t, "mathml svg", book.Chapters[0].Properties)
+		assert.Equal(t, "", book.Chapters[1].Properties)
+	}
+}
+
+func TestValidateReportsMissingProperties(t *testing.T) {
+	path := writeTestEpub(t, map[string]string{
+		"mimetype":               "application/epub+zip",
+		"META-INF/container.xml": `<container><rootfiles><rootfile full-path="content.opf"/></rootfiles></container>`,
+		"content.opf": `<package>
+<manifest>
+  <item id="a" href="a.xhtml" media-type="application/xhtml+xml"/>
+  <item id="b" href="b.xhtml" media-type="application/xhtml+xml" properties="mathml"/>
+</manifest>
+<spine><itemref idref="a"/><itemref idref="b"/></spine>
+</package>`,
+		"a.xhtml": `<html><body><svg xmlns="http://www.w3.org/2000/svg"/></body></html>`,
+		"b.xhtml": `<html><body><p>no math</p></body></html>`,
+	})
+	defer os.RemoveAll(filepath.Dir(path))
+
+	messages, err := Validate(path)
+	assert.NoError(t, err)
+	codes := validationCodes(messages)
+	assert.Contains(t, codes, "OPF-014")
+	assert.Contains(t, codes, "OPF-015")
+}
+
+// layoutFragment lays out MathML at size 16 and draws it at the baseline y
+func layoutFragment(t *testing.T, fragment string, y float64) (mathBox, string) {
+	root, err := parseMath(`<math>` + fragment + `</math>`)
+	if !assert.NoError(t, err) {
+		return emptyBox(), ""
+	}
+	box := layoutMath(root, mathFontSize)
+	var out strings.Builder
+	box.draw(&out, 0, y)
+	return box, out.String()
+}
+
+func TestLayoutScripts(t *testing.T) {
+	box, drawn := layoutFragment(t, `<msup><mi>x</mi><mn>2</mn></msup>`, 20)
+	assert.InDelta(t, 16.32, box.width, 0.001)
+	assert.InDelta(t, 15.6, box.ascent, 0.001)
+	assert.Equal(t, `<text x="0" y="20" font-size="16" font-style="italic">x</text><text x="9.6" y="12.8" font-size="11.2">2</text>`, drawn)
+}
+
+func TestLayoutFraction(t *testing.T) {
+	box, drawn := layoutFragment(t, `<mfrac><mn>1</mn><mn>22</mn></mfrac>`, 30)
+	assert.InDelta(t, 22.4, box.width, 0.001)
+	assert.InDelta(t, 23.2, box.ascent, 0.001)
+	assert.InDelta(t, 13.6, box.descent, 0.001)
+	assert.Equal(t, `<text x="6.4" y="18.8" font-size="16">1</text><text x="1.6" y="39.6" font-size="16">22</text>`+
+		`<line x1="0.8" y1="25.2" x2="21.6" y2="25.2" stroke="currentColor" stroke-width="0.96" />`, drawn)
+
+	_, drawn = layoutFragment(t, `<mfrac linethickness="0"><mn>1</mn><mn>2</mn></mfrac>`, 30)
+	assert.NotContains(t, drawn, "<line")
+}
+
+func TestLayoutSquareRoot(t *testing.T) {
+	box, drawn := layoutFragment(t, `<msqrt><mi>x</mi></msqrt>`, 20)
+	assert.InDelta(t, 20.8, box.width, 0.001)
+	assert.InDelta(t, 15.2, box.ascent, 0.001)
+	assert.InDelta(t, 4, box.descent, 0.001)
+	assert.Equal(t, `<path d="M0 15.2 L4 24 L8.8 5.6 L20.8 5.6" fill="none" stroke="currentColor" stroke-width="0.96" />`+
+		`<text x="9.6" y="20" font-size="16" font-style="italic">x</text>`, drawn)
+}
+
+func TestLayoutTable(t *testing.T) {
+	box, drawn := layoutFragment(t, `<mtable><mtr><mtd><mn>1</mn></mtd><mtd><mn>0</mn></mtd></mtr><mtr><mtd><mn>0</mn></mtd><mtd><mn>10</mn></mtd></mtr></mtable>`, 30)
+	assert.InDelta(t, 41.6, box.width, 0.001)
+	assert.InDelta(t, 23.2, box.ascent, 0.001)
+	assert.InDelta(t, 13.6, box.descent, 0.001)
+	assert.Equal(t, `<text x="0" y="18.8" font-size="16">1</text><text x="27.2" y="18.8" font-size="16">0</text>`+
+		`<text x="0" y="39.6" font-size="16">0</text><text x="22.4" y="39.6" font-size="16">10</text>`, drawn)
+}
+
+func TestMathFencedSeparators(t *testing.T) {
+	root, err := parseMath(`<math><mfenced separators="， ;"><mi>a</mi><mi>b</mi><mi>c</mi><mi>d</mi></mfenced></math>`)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "(a， b; c; d)", root.linear())
+	}
+}
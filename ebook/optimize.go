@@ -0,0 +1,224 @@
+package ebook
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	logrus "github.com/Sirupsen/logrus"
+	"golang.org/x/image/draw"
+)
+
+// ImageOptions configure the image processing between download and packaging
+type ImageOptions struct {
+	// MaxDimension downscales images whose width or height is larger, 0 keeps the size
+	MaxDimension int
+	// Grayscale drops the colors, e-ink screens show none anyway
+	Grayscale bool
+	// JPEGQuality recompresses JPEG images, 0 keeps them as they are
+	JPEGQuality int
+	// PNGToJPEG converts PNG images without transparency to JPEG
+	PNGToJPEG bool
+}
+
+// imagePresets are the ImageOptions for the devices of --device
+var imagePresets = map[string]ImageOptions{
+	"kindle-paperwhite": {MaxDimension: 1448, Grayscale: true, JPEGQuality: 75, PNGToJPEG: true},
+	"kobo":              {MaxDimension: 1680, Grayscale: true, JPEGQuality: 75, PNGToJPEG: true},
+	"tablet":            {MaxDimension: 2048, JPEGQuality: 85, PNGToJPEG: true},
+}
+
+// defaultJPEGQuality is used for converted PNG images without a quality
+const defaultJPEGQuality = 85
+
+// ImagePreset returns the ImageOptions of a device
+func ImagePreset(device string) (ImageOptions, error) {
+	options, ok := imagePresets[device]
+	if !ok {
+		return options, errors.New("unknown device " + device + ", expected one of " + strings.Join(ImagePresets(), ", "))
+	}
+	return options, nil
+}
+
+// ImagePresets lists the device names
+func ImagePresets() []string {
+	var names []string
+	for name := range imagePresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetImageOptions turns on image processing, nil turns it off
+func (e *Ebook) SetImageOptions(options *ImageOptions) {
+	e.imageOptions = options
+}
+
+// optimizeImages processes the downloaded images and returns the total size
+// before and after
+func (e *Ebook) optimizeImages() (before int64, after int64) {
+	for index, image := range e.images {
+		file := e.tempBookPath + "/OEBPS/" + image.Path
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		before += int64(len(data))
+
+		optimized, format, err := optimizeImage(data, *e.imageOptions)
+		if err != nil {
+			logrus.Debug("keep image " + image.Path + ": " + err.Error())
+			after += int64(len(data))
+			continue
+		}
+		after += int64(len(optimized))
+
+		// the download stays in place for the next incremental download
+		if media := "image/" + format; media != image.Media {
+			image.Path = e.convertedImagePath(index, image.Path, coverExtensions[format])
+			image.Media = media
+			file = e.tempBookPath + "/OEBPS/" + image.Path
+		}
+		check(ioutil.WriteFile(file, optimized, 0644))
+		e.images[index] = image
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"Title":  e.jsonBook.Title,
+		"Images": len(e.images),
+		"Before": before,
+		"After":  after,
+		"Saved":  before - after,
+	}).Info("Optimized images")
+	return before, after
+}
+
+// convertedImagePath is the path of image index converted to ext, numbered
+// when another image of the book has the path already
+func (e *Ebook) convertedImagePath(index int, original string, ext string) string {
+	base := strings.TrimSuffix(original, path.Ext(original))
+	candidate := base + "." + ext
+	for n := 2; e.imagePathUsed(index, candidate); n++ {
+		candidate = fmt.Sprintf("%s-%d.%s", base, n, ext)
+	}
+	return candidate
+}
+
+// imagePathUsed reports whether an image other than index is stored at p
+func (e *Ebook) imagePathUsed(index int, p string) bool {
+	for i, image := range e.images {
+		if i != index && image.Path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// errImageUnchanged keeps an image that the options would not make smaller
+var errImageUnchanged = errors.New("no smaller result")
+
+// optimizeImage applies the options to one encoded image and returns the
+// new encoding and its format
+func optimizeImage(data []byte, options ImageOptions) ([]byte, string, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	changed := false
+	if bounds := img.Bounds(); options.MaxDimension > 0 && (bounds.Dx() > options.MaxDimension || bounds.Dy() > options.MaxDimension) {
+		img = downscale(img, options.MaxDimension)
+		changed = true
+	}
+	if options.Grayscale && !isGray(img) {
+		img = grayscale(img)
+		changed = true
+	}
+
+	quality := options.JPEGQuality
+	if quality == 0 {
+		quality = defaultJPEGQuality
+	}
+	var out bytes.Buffer
+	switch {
+	case format == "jpeg" && (changed || options.JPEGQuality > 0):
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: quality})
+	case format == "png" && options.PNGToJPEG && isOpaque(img):
+		format = "jpeg"
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: quality})
+	case (format == "png" || format == "gif") && changed:
+		format = "png"
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&out, img)
+	default:
+		return nil, "", errImageUnchanged
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	// a resized image is kept even if it got larger, it fits the screen
+	if !changed && out.Len() >= len(data) {
+		return nil, "", errImageUnchanged
+	}
+	return out.Bytes(), format, nil
+}
+
+// downscale fits img into a square of max pixels, keeping the aspect ratio
+func downscale(img image.Image, max int) image.Image {
+	bounds := img.Bounds()
+	width, height := max, bounds.Dy()*max/bounds.Dx()
+	if bounds.Dy() > bounds.Dx() {
+		width, height = bounds.Dx()*max/bounds.Dy(), max
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	scaled := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+	return scaled
+}
+
+// grayscale converts the colors and keeps transparency
+func grayscale(img image.Image) image.Image {
+	bounds := img.Bounds()
+	if isOpaque(img) {
+		gray := image.NewGray(bounds)
+		draw.Draw(gray, bounds, img, bounds.Min, draw.Src)
+		return gray
+	}
+	gray := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			g := color.GrayModel.Convert(color.NRGBA{c.R, c.G, c.B, 0xff}).(color.Gray)
+			gray.SetNRGBA(x, y, color.NRGBA{g.Y, g.Y, g.Y, c.A})
+		}
+	}
+	return gray
+}
+
+func isGray(img image.Image) bool {
+	switch img.(type) {
+	case *image.Gray, *image.Gray16:
+		return true
+	}
+	return false
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
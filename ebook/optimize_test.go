@@ -0,0 +1,134 @@
+package ebook
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kkc/safari-books-downloader/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	var out bytes.Buffer
+	assert.NoError(t, png.Encode(&out, img))
+	return out.Bytes()
+}
+
+// screenshot is an opaque image with some noise, compressing like a photo
+func screenshot(width int, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 7), uint8(y * 13), uint8(x * y), 0xff})
+		}
+	}
+	return img
+}
+
+func TestOptimizeImageConvertsOpaquePNG(t *testing.T) {
+	preset, err := ImagePreset("kindle-paperwhite")
+	assert.NoError(t, err)
+	preset.MaxDimension = 100
+
+	data, format, err := optimizeImage(encodePNG(t, screenshot(400, 200)), preset)
+	assert.NoError(t, err)
+	assert.Equal(t, "jpeg", format)
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 100, 50), img.Bounds())
+	assert.IsType(t, &image.Gray{}, img)
+}
+
+func TestOptimizeImageKeepsTransparency(t *testing.T) {
+	img := screenshot(300, 300)
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 100; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{})
+		}
+	}
+
+	data, format, err := optimizeImage(encodePNG(t, img), ImageOptions{MaxDimension: 150, Grayscale: true, PNGToJPEG: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "png", format)
+	decoded, err := png.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, 150, decoded.Bounds().Dx())
+	_, _, _, alpha := decoded.At(0, 0).RGBA()
+	assert.Equal(t, uint32(0), alpha)
+}
+
+func TestOptimizeImageLeavesSmallImages(t *testing.T) {
+	_, _, err := optimizeImage(encodePNG(t, screenshot(10, 10)), ImageOptions{MaxDimension: 100})
+	assert.Equal(t, errImageUnchanged, err)
+
+	_, _, err = optimizeImage([]byte("not an image"), ImageOptions{MaxDimension: 100})
+	assert.Error(t, err)
+}
+
+func TestOptimizeImagesRenamesConvertedImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optimize")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	e := &Ebook{
+		jsonBook: JsonBook{Chapters: []Chapter{{
+			Filename: "ch01.html",
+			Content:  `<img src="https://example.com/assets/shot.png">`,
+			Images:   []string{"assets/shot.png"},
+		}}},
+		tempBookPath: dir,
+		imageOptions: &ImageOptions{PNGToJPEG: true},
+		progress:     utils.NopProgress,
+	}
+	prepareFolder(dir)
+	e.collectImages()
+	original := encodePNG(t, screenshot(300, 300))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "OEBPS", "images", "shot.png"), original, 0644))
+
+	before, after := e.optimizeImages()
+	assert.Equal(t, int64(len(original)), before)
+	assert.True(t, after < before)
+	assert.Equal(t, "images/shot.jpg", e.images[0].Path)
+	assert.Equal(t, "image/jpeg", e.images[0].Media)
+	// the original is kept for incremental downloads
+	_, err = os.Stat(filepath.Join(dir, "OEBPS", "images", "shot.png"))
+	assert.NoError(t, err)
+	assert.Equal(t, "images/shot.jpg", e.imagePath("assets/shot.png", "shot.png"))
+}
+
+func TestOptimizeImagesKeepsOtherImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optimize")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	e := &Ebook{
+		jsonBook: JsonBook{Chapters: []Chapter{{
+			Filename: "ch01.html",
+			Content:  `<img src="https://example.com/assets/shot.png"><img src="https://example.com/assets/shot.jpg">`,
+			Images:   []string{"assets/shot.png", "assets/shot.jpg"},
+		}}},
+		tempBookPath: dir,
+		imageOptions: &ImageOptions{PNGToJPEG: true},
+		progress:     utils.NopProgress,
+	}
+	prepareFolder(dir)
+	e.collectImages()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "OEBPS", "images", "shot.png"), encodePNG(t, screenshot(300, 300)), 0644))
+	photo := []byte("not a decodable image")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "OEBPS", "images", "shot.jpg"), photo, 0644))
+
+	e.optimizeImages()
+	assert.Equal(t, "images/shot-2.jpg", e.imagePath("assets/shot.png", "shot.png"))
+	assert.Equal(t, "images/shot.jpg", e.imagePath("assets/shot.jpg", "shot.jpg"))
+	kept, err := ioutil.ReadFile(filepath.Join(dir, "OEBPS", "images", "shot.jpg"))
+	assert.NoError(t, err)
+	assert.Equal(t, photo, kept)
+}
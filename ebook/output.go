@@ -0,0 +1,140 @@
+package ebook
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+// Collision policies for an output path that already exists
+const (
+	CollisionOverwrite = "overwrite"
+	CollisionSkip      = "skip"
+	CollisionSuffix    = "suffix"
+)
+
+// LibraryLayout stores books as Publisher/Author/Title.epub
+const LibraryLayout = "library"
+
+const libraryTemplate = "{{.Publisher}}/{{.Authors}}/{{.Title}}.epub"
+
+// maximal length of one path element, most filesystems allow 255 bytes
+const maxNameLength = 200
+
+// OutputOptions decide where a book is saved
+type OutputOptions struct {
+	// Template is a text/template over OutputFields, e.g. "{{.Title}}.epub"
+	Template string
+	// Dir the rendered path is relative to
+	Dir string
+	// Layout is empty or LibraryLayout, which replaces Template
+	Layout string
+	// Collision is one of the Collision* policies, empty overwrites
+	Collision string
+}
+
+// OutputFields are the book metadata available to the output template. All
+// values are safe to use as a filename.
+type OutputFields struct {
+	Title     string
+	Authors   string
+	Isbn      string
+	Publisher string
+	Issued    string
+}
+
+var unsafeNameReg = regexp.MustCompile(`[/\\:*?"<>|\x00-\x1f]+`)
+var spacesReg = regexp.MustCompile(`\s+`)
+
+// sanitizeName makes s usable as a single path element
+func sanitizeName(s string) string {
+	s = unsafeNameReg.ReplaceAllString(s, " ")
+	s = spacesReg.ReplaceAllString(s, " ")
+	s = strings.Trim(s, " .")
+	for len(s) > maxNameLength {
+		// drop whole characters, never half of a multi-byte one
+		_, size := utf8.DecodeLastRuneInString(s)
+		s = s[:len(s)-size]
+	}
+	s = strings.TrimRight(s, " .")
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+func outputFields(book JsonBook) OutputFields {
+	issued := book.Issued
+	if len(issued) > 10 {
+		// only keep the date of a timestamp
+		issued = issued[:10]
+	}
+	return OutputFields{
+		Title:     sanitizeName(book.Title),
+		Authors:   sanitizeName(strings.Join(book.Author, ", ")),
+		Isbn:      sanitizeName(book.Isbn),
+		Publisher: sanitizeName(strings.Join(book.Publisher, ", ")),
+		Issued:    sanitizeName(issued),
+	}
+}
+
+// OutputPath renders the path the book is saved to. skip is true when the
+// path exists and the collision policy is to skip the book.
+func (e *Ebook) OutputPath(options OutputOptions) (path string, skip bool, err error) {
+	return BookOutputPath(e.jsonBook, options)
+}
+
+// BookOutputPath is OutputPath for a book that is not fetched yet, only the
+// metadata of the book is used
+func BookOutputPath(book JsonBook, options OutputOptions) (path string, skip bool, err error) {
+	tmpl := options.Template
+	if options.Layout == LibraryLayout {
+		tmpl = libraryTemplate
+	} else if options.Layout != "" {
+		return "", false, fmt.Errorf("invalid layout %q, expected %s", options.Layout, LibraryLayout)
+	}
+	if tmpl == "" {
+		tmpl = "ebook.epub"
+	}
+
+	t, err := template.New("output").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", false, err
+	}
+	var rendered bytes.Buffer
+	if err = t.Execute(&rendered, outputFields(book)); err != nil {
+		return "", false, err
+	}
+	path = filepath.Join(options.Dir, filepath.FromSlash(rendered.String()))
+	// titles like Node.js have an extension of their own
+	if !strings.EqualFold(filepath.Ext(path), ".epub") {
+		path += ".epub"
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return path, false, nil
+	}
+
+	switch options.Collision {
+	case "", CollisionOverwrite:
+		return path, false, nil
+	case CollisionSkip:
+		return path, true, nil
+	case CollisionSuffix:
+		ext := filepath.Ext(path)
+		base := strings.TrimSuffix(path, ext)
+		for i := 1; ; i++ {
+			candidate := base + "-" + strconv.Itoa(i) + ext
+			if _, err := os.Stat(candidate); os.IsNotExist(err) {
+				return candidate, false, nil
+			}
+		}
+	}
+	return "", false, fmt.Errorf("invalid collision policy %q, expected %s, %s or %s", options.Collision, CollisionSkip, CollisionOverwrite, CollisionSuffix)
+}
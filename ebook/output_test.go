@@ -0,0 +1,88 @@
+package ebook
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newOutputTestEbook() *Ebook {
+	return &Ebook{jsonBook: JsonBook{
+		Title:     "REST API Design Rulebook: Designing Consistent RESTful Web Service Interfaces",
+		Author:    []string{"Mark Masse"},
+		Publisher: []string{"O'Reilly Media, Inc."},
+		Isbn:      "9781449310509",
+		Issued:    "2011-10-18T00:00:00Z",
+	}}
+}
+
+func TestSanitizeName(t *testing.T) {
+	assert.Equal(t, "AC DC Back in Black", sanitizeName("AC/DC: Back  in Black?"))
+	assert.Equal(t, "unknown", sanitizeName(" ..."))
+	assert.Equal(t, "hidden", sanitizeName(".hidden."))
+
+	long := sanitizeName(strings.Repeat("é", 150))
+	assert.True(t, len(long) <= maxNameLength)
+	assert.Equal(t, strings.Repeat("é", 100), long)
+}
+
+func TestOutputPathTemplate(t *testing.T) {
+	e := newOutputTestEbook()
+
+	path, skip, err := e.OutputPath(OutputOptions{Template: "{{.Isbn}} - {{.Title}}", Dir: "out"})
+	assert.NoError(t, err)
+	assert.False(t, skip)
+	assert.Equal(t, filepath.Join("out", "9781449310509 - REST API Design Rulebook Designing Consistent RESTful Web Service Interfaces.epub"), path)
+
+	path, _, err = e.OutputPath(OutputOptions{Template: "{{.Issued}}/{{.Authors}}.epub"})
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join("2011-10-18", "Mark Masse.epub"), path)
+
+	path, _, err = e.OutputPath(OutputOptions{Layout: LibraryLayout, Dir: "library"})
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join("library", "O'Reilly Media, Inc", "Mark Masse", "REST API Design Rulebook Designing Consistent RESTful Web Service Interfaces.epub"), path)
+
+	path, _, err = BookOutputPath(JsonBook{Title: "Node.js in Action"}, OutputOptions{Template: "{{.Title}}"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Node.js in Action.epub", path)
+	path, _, err = BookOutputPath(JsonBook{Title: "ASP.NET"}, OutputOptions{Template: "{{.Title}}.EPUB"})
+	assert.NoError(t, err)
+	assert.Equal(t, "ASP.NET.EPUB", path)
+
+	_, _, err = e.OutputPath(OutputOptions{Template: "{{.Missing}}"})
+	assert.Error(t, err)
+	_, _, err = e.OutputPath(OutputOptions{Layout: "shelves"})
+	assert.Error(t, err)
+}
+
+func TestOutputPathCollision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	e := newOutputTestEbook()
+	existing := filepath.Join(dir, "9781449310509.epub")
+	assert.NoError(t, ioutil.WriteFile(existing, nil, 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "9781449310509-1.epub"), nil, 0644))
+
+	options := OutputOptions{Template: "{{.Isbn}}.epub", Dir: dir}
+	for policy, expected := range map[string]string{
+		CollisionOverwrite: existing,
+		CollisionSkip:      existing,
+		CollisionSuffix:    filepath.Join(dir, "9781449310509-2.epub"),
+	} {
+		options.Collision = policy
+		path, skip, err := e.OutputPath(options)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, path)
+		assert.Equal(t, policy == CollisionSkip, skip)
+	}
+
+	options.Collision = "rename"
+	_, _, err = e.OutputPath(options)
+	assert.Error(t, err)
+}
@@ -0,0 +1,293 @@
+package ebook
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"html"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type epubContainer struct {
+	Rootfiles []struct {
+		FullPath  string `xml:"full-path,attr"`
+		MediaType string `xml:"media-type,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type opfIdentifier struct {
+	Id     string `xml:"id,attr"`
+	Scheme string `xml:"scheme,attr"`
+	Value  string `xml:",chardata"`
+}
+
+type opfItem struct {
+	Id         string `xml:"id,attr"`
+	Href       string `xml:"href,attr"`
+	MediaType  string `xml:"media-type,attr"`
+	Properties string `xml:"properties,attr"`
+}
+
+type opfPackage struct {
+	UniqueIdentifier string `xml:"unique-identifier,attr"`
+	Metadata         struct {
+		Identifiers []opfIdentifier `xml:"identifier"`
+		Title       string          `xml:"title"`
+		Language    string          `xml:"language"`
+		Creators    []string        `xml:"creator"`
+		Publishers  []string        `xml:"publisher"`
+		Description string          `xml:"description"`
+		Date        string          `xml:"date"`
+		Meta        []struct {
+			Name    string `xml:"name,attr"`
+			Content string `xml:"content,attr"`
+		} `xml:"meta"`
+	} `xml:"metadata"`
+	Manifest []opfItem `xml:"manifest>item"`
+	Spine    struct {
+		Toc      string `xml:"toc,attr"`
+		Itemrefs []struct {
+			Idref string `xml:"idref,attr"`
+		} `xml:"itemref"`
+	} `xml:"spine"`
+}
+
+type ncxNavPoint struct {
+	Label   string `xml:"navLabel>text"`
+	Content struct {
+		Src string `xml:"src,attr"`
+	} `xml:"content"`
+	Children []ncxNavPoint `xml:"navPoint"`
+}
+
+type ncxDocument struct {
+	NavPoints []ncxNavPoint `xml:"navMap>navPoint"`
+}
+
+var bodyReg = regexp.MustCompile(`(?is)<body[^>]*>(.*)</body>`)
+var titleReg = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+var imageSrcReg = regexp.MustCompile(`(?is)<img\s[^>]*?src="([^"]*)"`)
+var tocNavReg = regexp.MustCompile(`(?is)<nav[^>]*epub:type="toc"[^>]*>(.*?)</nav>`)
+var navLinkReg = regexp.MustCompile(`(?is)<a[^>]*href="([^"]*)"[^>]*>(.*?)</a>`)
+
+// epubReader reads the files of an epub relative to its package document
+type epubReader struct {
+	files   map[string]*zip.File
+	baseDir string
+}
+
+func (r *epubReader) read(name string) ([]byte, error) {
+	f, ok := r.files[name]
+	if !ok {
+		return nil, errors.New("epub has no file " + name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// resolve turns an href of the package document into a name in the zip
+func (r *epubReader) resolve(href string) string {
+	return path.Join(r.baseDir, href)
+}
+
+// Open reads an epub back into a JsonBook without touching the network.
+// Chapters are in spine order and take their titles from the nav document
+// or the NCX. Cover and image paths are relative to the package document.
+func Open(epubPath string) (*JsonBook, error) {
+	archive, err := zip.OpenReader(epubPath)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	r := &epubReader{files: make(map[string]*zip.File)}
+	for _, f := range archive.File {
+		r.files[f.Name] = f
+	}
+
+	content, err := r.read("META-INF/container.xml")
+	if err != nil {
+		return nil, err
+	}
+	var container epubContainer
+	if err := xml.Unmarshal(content, &container); err != nil {
+		return nil, err
+	}
+	if len(container.Rootfiles) == 0 {
+		return nil, errors.New("container.xml has no rootfile")
+	}
+	opfPath := container.Rootfiles[0].FullPath
+	r.baseDir = path.Dir(opfPath)
+
+	content, err = r.read(opfPath)
+	if err != nil {
+		return nil, err
+	}
+	var opf opfPackage
+	if err := xml.Unmarshal(content, &opf); err != nil {
+		return nil, err
+	}
+
+	book := bookMetadata(&opf)
+	items := make(map[string]opfItem)
+	for _, item := range opf.Manifest {
+		items[item.Id] = item
+		if hasProperty(item.Properties, "cover-image") {
+			book.Cover = item.Href
+		}
+	}
+	for _, meta := range opf.Metadata.Meta {
+		if meta.Name == "cover" {
+			if item, ok := items[meta.Content]; ok {
+				book.Cover = item.Href
+			}
+		}
+	}
+
+	labels, err := r.tocLabels(&opf, items)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, itemref := range opf.Spine.Itemrefs {
+		item, ok := items[itemref.Idref]
+		if !ok {
+			return nil, errors.New("spine references unknown item " + itemref.Idref)
+		}
+		// the cover page added by the writer is not a chapter of the book
+		if item.Id == coverPageId {
+			continue
+		}
+		content, err := r.read(r.resolve(item.Href))
+		if err != nil {
+			return nil, err
+		}
+		chapter := parseChapter(item.Id, item.Href, len(book.Chapters)+1, string(content))
+		if label, ok := labels[item.Href]; ok {
+			chapter.Title = label
+		}
+		book.Chapters = append(book.Chapters, chapter)
+	}
+	return book, nil
+}
+
+// bookMetadata maps the OPF metadata onto a JsonBook
+func bookMetadata(opf *opfPackage) *JsonBook {
+	metadata := opf.Metadata
+	book := &JsonBook{
+		Title:       strings.TrimSpace(metadata.Title),
+		Language:    strings.TrimSpace(metadata.Language),
+		Description: strings.TrimSpace(metadata.Description),
+		Issued:      strings.TrimSpace(metadata.Date),
+	}
+	for _, creator := range metadata.Creators {
+		book.Author = append(book.Author, strings.TrimSpace(creator))
+	}
+	for _, publisher := range metadata.Publishers {
+		book.Publisher = append(book.Publisher, strings.TrimSpace(publisher))
+	}
+	for _, identifier := range metadata.Identifiers {
+		value := strings.TrimSpace(identifier.Value)
+		if identifier.Id == opf.UniqueIdentifier || book.Uuid == "" {
+			book.Uuid = value
+		}
+		if strings.EqualFold(identifier.Scheme, "isbn") {
+			book.Isbn = value
+		} else if strings.HasPrefix(strings.ToLower(value), "urn:isbn:") {
+			book.Isbn = value[len("urn:isbn:"):]
+		}
+	}
+	return book
+}
+
+// tocLabels maps chapter hrefs to their label in the nav document, or the
+// NCX for EPUB 2 books
+func (r *epubReader) tocLabels(opf *opfPackage, items map[string]opfItem) (map[string]string, error) {
+	labels := make(map[string]string)
+	// links are relative to the toc document, chapters to the package
+	add := func(tocHref string, link string, label string) {
+		link = strings.SplitN(link, "#", 2)[0]
+		if link == "" {
+			return
+		}
+		href := path.Join(path.Dir(tocHref), link)
+		if _, ok := labels[href]; !ok {
+			labels[href] = strings.TrimSpace(label)
+		}
+	}
+
+	for _, item := range opf.Manifest {
+		if !hasProperty(item.Properties, "nav") {
+			continue
+		}
+		content, err := r.read(r.resolve(item.Href))
+		if err != nil {
+			return nil, err
+		}
+		if nav := tocNavReg.FindStringSubmatch(string(content)); nav != nil {
+			for _, link := range navLinkReg.FindAllStringSubmatch(nav[1], -1) {
+				add(item.Href, link[1], html.UnescapeString(tagReg.ReplaceAllString(link[2], "")))
+			}
+			return labels, nil
+		}
+	}
+
+	ncx, ok := items[opf.Spine.Toc]
+	if !ok {
+		return labels, nil
+	}
+	content, err := r.read(r.resolve(ncx.Href))
+	if err != nil {
+		return nil, err
+	}
+	var document ncxDocument
+	if err := xml.Unmarshal(content, &document); err != nil {
+		return nil, err
+	}
+	var walk func(points []ncxNavPoint)
+	walk = func(points []ncxNavPoint) {
+		for _, point := range points {
+			add(ncx.Href, point.Content.Src, point.Label)
+			walk(point.Children)
+		}
+	}
+	walk(document.NavPoints)
+	return labels, nil
+}
+
+func hasProperty(properties string, property string) bool {
+	for _, p := range strings.Fields(properties) {
+		if p == property {
+			return true
+		}
+	}
+	return false
+}
+
+// parseChapter takes the title, body and images of a chapter file. Image
+// paths are made relative to the package document like the filename.
+func parseChapter(id string, filename string, order int, content string) Chapter {
+	chapter := Chapter{
+		Id:       id,
+		Filename: filename,
+		Order:    order,
+	}
+	if match := titleReg.FindStringSubmatch(content); match != nil {
+		chapter.Title = html.UnescapeString(strings.TrimSpace(match[1]))
+	}
+	if match := bodyReg.FindStringSubmatch(content); match != nil {
+		chapter.Content = strings.TrimSpace(match[1])
+	}
+	chapter.Properties = chapterProperties(chapter.Content)
+	for _, match := range imageSrcReg.FindAllStringSubmatch(chapter.Content, -1) {
+		chapter.Images = append(chapter.Images, path.Join(path.Dir(filename), match[1]))
+	}
+	return chapter
+}
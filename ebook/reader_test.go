@@ -0,0 +1,226 @@
+package ebook
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/kkc/safari-books-downloader/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestEpub zips files into an epub in a temp dir
+func writeTestEpub(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "epub")
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "book.epub")
+
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	archive := zip.NewWriter(f)
+	for name, content := range files {
+		w, err := archive.Create(name)
+		assert.NoError(t, err)
+		w.Write([]byte(content))
+	}
+	assert.NoError(t, archive.Close())
+	return path
+}
+
+func TestOpenReadsChaptersInSpineOrder(t *testing.T) {
+	path := writeTestEpub(t, map[string]string{
+		"META-INF/container.xml": `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+<rootfiles><rootfile full-path="OPS/book.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`,
+		"OPS/book.opf": `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" xmlns:dc="http://purl.org/dc/elements/1.1/">
+<metadata><dc:title>A Book</dc:title></metadata>
+<manifest>
+  <item id="b" href="text/b.xhtml" media-type="application/xhtml+xml"/>
+  <item id="a" href="text/a.xhtml" media-type="application/xhtml+xml"/>
+</manifest>
+<spine><itemref idref="a"/><itemref idref="b"/></spine>
+</package>`,
+		"OPS/text/a.xhtml": `<html><head><title>First &amp; only</title></head><body>
+  <p>a</p><img src="../images/a.png" alt=""/>
+</body></html>`,
+		"OPS/text/b.xhtml": `<html><head><title>Second</title></head><body><p>b</p></body></html>`,
+	})
+	defer os.RemoveAll(filepath.Dir(path))
+
+	book, err := Open(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "A Book", book.Title)
+	if assert.Len(t, book.Chapters, 2) {
+		assert.Equal(t, Chapter{
+			Id:       "a",
+			Filename: "text/a.xhtml",
+			Order:    1,
+			Title:    "First & only",
+			Content:  `<p>a</p><img src="../images/a.png" alt=""/>`,
+			Images:   []string{"images/a.png"},
+		}, book.Chapters[0])
+		assert.Equal(t, "b", book.Chapters[1].Id)
+	}
+}
+
+func TestOpenReadsNavLabelsAndIsbn(t *testing.T) {
+	path := writeTestEpub(t, map[string]string{
+		"META-INF/container.xml": `<container><rootfiles><rootfile full-path="content.opf"/></rootfiles></container>`,
+		"content.opf": `<package unique-identifier="uid">
+<metadata>
+  <dc:identifier id="isbn" opf:scheme="ISBN">9781449317904</dc:identifier>
+  <dc:identifier id="uid">urn:uuid:1234</dc:identifier>
+  <dc:title>A Book</dc:title>
+</metadata>
+<manifest>
+  <item id="nav" href="nav.xhtml" properties="nav" media-type="application/xhtml+xml"/>
+  <item id="cover" href="cover.png" properties="cover-image" media-type="image/png"/>
+  <item id="a" href="a.xhtml" media-type="application/xhtml+xml"/>
+</manifest>
+<spine><itemref idref="a"/></spine>
+</package>`,
+		"nav.xhtml": `<html><body><nav epub:type="toc"><ol>
+  <li><a href="a.xhtml#top"><span>Chapter &amp; One</span></a></li>
+</ol></nav></body></html>`,
+		"a.xhtml": `<html><head><title>ignored</title></head><body><p>a</p></body></html>`,
+	})
+	defer os.RemoveAll(filepath.Dir(path))
+
+	book, err := Open(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "urn:uuid:1234", book.Uuid)
+	assert.Equal(t, "9781449317904", book.Isbn)
+	assert.Equal(t, "cover.png", book.Cover)
+	if assert.Len(t, book.Chapters, 1) {
+		assert.Equal(t, "Chapter & One", book.Chapters[0].Title)
+	}
+}
+
+// emptyFetcher downloads every asset as an empty file
+type emptyFetcher struct{}
+
+func (emptyFetcher) FetchAsset(url string) ([]byte, error) {
+	return nil, nil
+}
+
+// writeTestBook writes a book with the ebook writer, with empty files for
+// the images and stylesheet. Books without cover get a generated one. The
+// setup functions change the writer options.
+func writeTestBook(t *testing.T, book JsonBook, setup ...func(e *Ebook)) string {
+	dir, err := ioutil.TempDir("", "ebook")
+	assert.NoError(t, err)
+	return writeTestBookTo(t, dir, book, setup...)
+}
+
+// writeTestBookTo builds the book in dir/build and saves it as dir/book.epub
+func writeTestBookTo(t *testing.T, dir string, book JsonBook, setup ...func(e *Ebook)) string {
+	e := &Ebook{
+		jsonBook:     book,
+		tempBookPath: filepath.Join(dir, "build"),
+		fetcher:      emptyFetcher{},
+		progress:     utils.NopProgress,
+	}
+	for _, f := range setup {
+		f(e)
+	}
+	prepareFolder(e.tempBookPath)
+	writeMimeType(e.tempBookPath)
+	writeContainer(e.tempBookPath)
+
+	// empty files in place of the images
+	e.collectImages()
+	for _, image := range e.images {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(e.tempBookPath, "OEBPS", image.Path), nil, 0644))
+	}
+
+	e.writeBook()
+
+	path := filepath.Join(dir, "book.epub")
+	e.generateEpub(path)
+	return path
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	written := JsonBook{
+		Title:       "Learning Go",
+		Uuid:        "9781449317904",
+		Language:    "en",
+		Author:      []string{"Jane Doe", "John Roe"},
+		Description: "<p>Learn Go & more</p>",
+		Publisher:   []string{"Tom & Jerry"},
+		Issued:      "2016-03-01",
+		Chapters: []Chapter{
+			{Id: "cover", Filename: "cover.html", Order: 1, Title: "Cover", Content: "<p>cover</p>"},
+			{Id: "ch01", Filename: "ch01.html", Order: 2, Title: "Getting Started", Content: `<p>Hello</p><img src="https://example.com/assets/gopher.png" alt="gopher">`, Images: []string{"assets/gopher.png"}},
+		},
+	}
+	path := writeTestBook(t, written)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	book, err := Open(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, written.Title, book.Title)
+	assert.Equal(t, written.Uuid, book.Uuid)
+	assert.Equal(t, written.Language, book.Language)
+	assert.Equal(t, written.Author, book.Author)
+	assert.Equal(t, written.Description, book.Description)
+	assert.Equal(t, written.Publisher, book.Publisher)
+	assert.Equal(t, written.Issued, book.Issued)
+	assert.Equal(t, "cover-image.png", book.Cover)
+	if assert.Len(t, book.Chapters, 2) {
+		for i, chapter := range book.Chapters {
+			assert.Equal(t, written.Chapters[i].Id, chapter.Id)
+			assert.Equal(t, written.Chapters[i].Filename, chapter.Filename)
+			assert.Equal(t, written.Chapters[i].Order, chapter.Order)
+			assert.Equal(t, written.Chapters[i].Title, chapter.Title)
+		}
+		assert.Equal(t, "<p>cover</p>", book.Chapters[0].Content)
+		assert.Equal(t, `<p>Hello</p><img src="images/gopher.png" alt="gopher" />`, book.Chapters[1].Content)
+		assert.Equal(t, []string{"images/gopher.png"}, book.Chapters[1].Images)
+	}
+}
+
+func TestSaveKeepsOnlyManifestFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ebook")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	book := JsonBook{
+		Title:    "Learning Go",
+		Uuid:     "9781449317904",
+		Language: "en",
+		Chapters: []Chapter{
+			{Id: "ch01", Filename: "ch01.html", Order: 1, Title: "One", Content: "<p>One</p>"},
+			{Id: "ch02", Filename: "ch02.html", Order: 2, Title: "Two", Content: `<img src="https://example.com/assets/gopher.png" alt="gopher">`, Images: []string{"assets/gopher.png"}},
+		},
+	}
+	writeTestBookTo(t, dir, book)
+	book.Chapters = book.Chapters[:1]
+	path := writeTestBookTo(t, dir, book)
+
+	archive, err := zip.OpenReader(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer archive.Close()
+	var names []string
+	for _, f := range archive.File {
+		names = append(names, f.Name)
+	}
+	expected := []string{"mimetype", "META-INF/container.xml", "OEBPS/content.opf"}
+	for _, match := range regexp.MustCompile(`<item id="[^"]*" href="([^"]*)"`).FindAllStringSubmatch(readEpubFile(t, path, "OEBPS/content.opf"), -1) {
+		expected = append(expected, "OEBPS/"+match[1])
+	}
+	assert.ElementsMatch(t, expected, names)
+	assert.NotContains(t, names, "OEBPS/ch02.html")
+	assert.NotContains(t, names, "OEBPS/images/gopher.png")
+}
@@ -0,0 +1,113 @@
+package ebook
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// StyleOptions pick the stylesheets of a book
+type StyleOptions struct {
+	// Theme is one of Themes, empty is the default theme
+	Theme string
+	// UserCSS is the path of a stylesheet linked after all others
+	UserCSS string
+	// StripPublisher leaves out the stylesheet of the publisher
+	StripPublisher bool
+}
+
+// DefaultTheme is the bundled style.css
+const DefaultTheme = "default"
+
+// themes lists the bundled files that make up style.css, the
+// publisher theme only keeps the publisher stylesheet
+var themes = map[string][]string{
+	DefaultTheme: {"style.css"},
+	"publisher":  nil,
+	"minimal":    {"themes/minimal.css"},
+	"large-type": {"themes/minimal.css", "themes/large-type.css"},
+	"dark":       {"themes/minimal.css", "themes/dark.css"},
+}
+
+// userCSSFile is the name of the user stylesheet in the epub
+const userCSSFile = "user.css"
+
+// Themes lists the theme names
+func Themes() []string {
+	var names []string
+	for name := range themes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckTheme reports an unknown theme
+func CheckTheme(theme string) error {
+	if _, ok := themes[theme]; !ok {
+		return errors.New("unknown theme " + theme + ", expected one of " + strings.Join(Themes(), ", "))
+	}
+	return nil
+}
+
+// SetStyleOptions picks the theme and the user stylesheet
+func (e *Ebook) SetStyleOptions(options StyleOptions) {
+	e.style = options
+}
+
+// publisherCSS reports whether core.css is part of the book
+func (e *Ebook) publisherCSS() bool {
+	return e.jsonBook.Stylesheet != "" && !e.style.StripPublisher
+}
+
+// stylesheetLinks returns the links of a chapter: the publisher stylesheet,
+// the theme and the user stylesheet, so later ones override earlier ones
+func (e *Ebook) stylesheetLinks() string {
+	var links []string
+	if e.publisherCSS() {
+		links = append(links, "core.css")
+	}
+	links = append(links, "style.css")
+	if e.style.UserCSS != "" {
+		links = append(links, userCSSFile)
+	}
+	var out []string
+	for _, link := range links {
+		out = append(out, `<link type="text/css" rel="stylesheet" media="all" href="`+link+`" />`)
+	}
+	return strings.Join(out, "\n  ")
+}
+
+// writeTheme copies the theme files into style.css
+func (e *Ebook) writeTheme(out io.Writer) {
+	theme := e.style.Theme
+	if theme == "" {
+		theme = DefaultTheme
+	}
+	for _, file := range themes[theme] {
+		in, err := assets.Open(file)
+		check(err)
+		_, err = io.Copy(out, in)
+		in.Close()
+		check(err)
+	}
+}
+
+// writeUserCSS copies the user stylesheet into the book
+func (e *Ebook) writeUserCSS() {
+	if e.style.UserCSS == "" {
+		return
+	}
+	in, err := os.Open(e.style.UserCSS)
+	check(err)
+	defer in.Close()
+
+	out, err := os.Create(e.tempBookPath + "/OEBPS/" + userCSSFile)
+	check(err)
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	check(err)
+}
@@ -0,0 +1,122 @@
+package ebook
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readEpubFile returns one file of an epub
+func readEpubFile(t *testing.T, path string, name string) string {
+	archive, err := zip.OpenReader(path)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer archive.Close()
+	r := &epubReader{files: make(map[string]*zip.File)}
+	for _, f := range archive.File {
+		r.files[f.Name] = f
+	}
+	content, err := r.read(name)
+	assert.NoError(t, err)
+	return string(content)
+}
+
+func TestStylesheetLinks(t *testing.T) {
+	e := &Ebook{jsonBook: JsonBook{Stylesheet: "https://example.com/core.css"}}
+	assert.Equal(t, `<link type="text/css" rel="stylesheet" media="all" href="core.css" />
+  <link type="text/css" rel="stylesheet" media="all" href="style.css" />`, e.stylesheetLinks())
+
+	e.style = StyleOptions{UserCSS: "/home/me/kobo.css"}
+	assert.Equal(t, `<link type="text/css" rel="stylesheet" media="all" href="core.css" />
+  <link type="text/css" rel="stylesheet" media="all" href="style.css" />
+  <link type="text/css" rel="stylesheet" media="all" href="user.css" />`, e.stylesheetLinks())
+
+	e.style = StyleOptions{UserCSS: "/home/me/kobo.css", StripPublisher: true}
+	assert.Equal(t, `<link type="text/css" rel="stylesheet" media="all" href="style.css" />
+  <link type="text/css" rel="stylesheet" media="all" href="user.css" />`, e.stylesheetLinks())
+}
+
+func TestCheckTheme(t *testing.T) {
+	assert.Equal(t, []string{"dark", "default", "large-type", "minimal", "publisher"}, Themes())
+	for _, theme := range Themes() {
+		assert.NoError(t, CheckTheme(theme))
+	}
+	assert.Error(t, CheckTheme("sepia"))
+}
+
+func TestWriteThemeAndUserCSS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "themes")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	userCSS := filepath.Join(dir, "kobo.css")
+	assert.NoError(t, ioutil.WriteFile(userCSS, []byte("p { text-indent: 1em }\n"), 0644))
+
+	book := JsonBook{
+		Title:      "Learning Go",
+		Uuid:       "9781449317904",
+		Language:   "en",
+		Stylesheet: "https://example.com/core.css",
+		Chapters:   []Chapter{{Id: "ch01", Filename: "ch01.html", Order: 1, Title: "One", Content: "<p>Hello</p>"}},
+	}
+	path := writeTestBook(t, book, func(e *Ebook) {
+		e.SetStyleOptions(StyleOptions{Theme: "dark", UserCSS: userCSS, StripPublisher: true})
+	})
+	defer os.RemoveAll(filepath.Dir(path))
+
+	messages, err := Validate(path)
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+
+	style := readEpubFile(t, path, "OEBPS/style.css")
+	assert.Contains(t, style, "/* minimal:")
+	assert.Contains(t, style, "/* dark:")
+	assert.Equal(t, "p { text-indent: 1em }\n", readEpubFile(t, path, "OEBPS/user.css"))
+
+	opf := readEpubFile(t, path, "OEBPS/content.opf")
+	assert.Contains(t, opf, `href="user.css"`)
+	assert.NotContains(t, opf, `href="core.css"`)
+
+	chapter := readEpubFile(t, path, "OEBPS/ch01.html")
+	assert.True(t, strings.Index(chapter, `href="style.css"`) < strings.Index(chapter, `href="user.css"`))
+	assert.NotContains(t, chapter, "core.css")
+}
+
+func TestWritePublisherTheme(t *testing.T) {
+	path := writeTestBook(t, JsonBook{
+		Title:      "Learning Go",
+		Uuid:       "9781449317904",
+		Language:   "en",
+		Stylesheet: "https://example.com/core.css",
+		Chapters:   []Chapter{{Id: "ch01", Filename: "ch01.html", Order: 1, Title: "One", Content: "<p>Hello</p>"}},
+	}, func(e *Ebook) {
+		e.SetStyleOptions(StyleOptions{Theme: "publisher"})
+	})
+	defer os.RemoveAll(filepath.Dir(path))
+
+	assert.Equal(t, "", readEpubFile(t, path, "OEBPS/style.css"))
+	chapter := readEpubFile(t, path, "OEBPS/ch01.html")
+	assert.True(t, strings.Index(chapter, `href="core.css"`) < strings.Index(chapter, `href="style.css"`))
+}
+
+func TestDownloadStylesheetUsesFetcher(t *testing.T) {
+	book := JsonBook{Stylesheet: "https://example.com/core.css"}
+	e := newCoverTestEbook(t, book, fakeFetcher{"https://example.com/core.css": []byte("p { margin: 0 }")})
+	defer os.RemoveAll(e.tempBookPath)
+	e.downloadStylesheet()
+	content, err := ioutil.ReadFile(filepath.Join(e.tempBookPath, "OEBPS", "core.css"))
+	assert.NoError(t, err)
+	assert.Equal(t, "p { margin: 0 }", string(content))
+
+	// a failed download leaves an empty stylesheet instead of stopping
+	e.fetcher = fakeFetcher{}
+	e.downloadStylesheet()
+	content, err = ioutil.ReadFile(filepath.Join(e.tempBookPath, "OEBPS", "core.css"))
+	assert.NoError(t, err)
+	assert.Empty(t, content)
+}
@@ -0,0 +1,285 @@
+package ebook
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ValidationMessage is one error found by Validate, the codes follow
+// epubcheck
+type ValidationMessage struct {
+	Code    string
+	File    string
+	Line    int
+	Message string
+}
+
+func (m ValidationMessage) String() string {
+	location := m.File
+	if m.Line > 0 {
+		location = fmt.Sprintf("%s(%d)", m.File, m.Line)
+	}
+	if location != "" {
+		location += ": "
+	}
+	return fmt.Sprintf("ERROR(%s): %s%s", m.Code, location, m.Message)
+}
+
+// validator collects the messages while checking one epub
+type validator struct {
+	reader   *epubReader
+	messages []ValidationMessage
+	// manifest hrefs resolved to names in the zip
+	manifest map[string]opfItem
+}
+
+func (v *validator) report(code string, file string, line int, format string, args ...interface{}) {
+	v.messages = append(v.messages, ValidationMessage{
+		Code:    code,
+		File:    file,
+		Line:    line,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Validate checks an epub offline for the problems that crash readers:
+// mimetype placement, container and package parsing, spine and manifest
+// references, unique ids, well-formed XHTML, media types and the mathml and
+// svg properties. The error is only set when the file is not a zip archive.
+func Validate(epubPath string) ([]ValidationMessage, error) {
+	archive, err := zip.OpenReader(epubPath)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	v := &validator{
+		reader:   &epubReader{files: make(map[string]*zip.File)},
+		manifest: make(map[string]opfItem),
+	}
+	for _, f := range archive.File {
+		v.reader.files[f.Name] = f
+	}
+
+	v.checkMimetype(archive.File)
+	opfPath, ok := v.checkContainer()
+	if ok {
+		v.checkPackage(opfPath)
+	}
+	return v.messages, nil
+}
+
+func (v *validator) checkMimetype(files []*zip.File) {
+	if len(files) == 0 || files[0].Name != "mimetype" {
+		v.report("PKG-006", "mimetype", 0, "mimetype file entry is missing or is not the first file in the archive")
+		if _, ok := v.reader.files["mimetype"]; !ok {
+			return
+		}
+	}
+	f := v.reader.files["mimetype"]
+	if f.Method != zip.Store {
+		v.report("PKG-007", "mimetype", 0, "mimetype file should not be compressed")
+	}
+	content, err := v.reader.read("mimetype")
+	if err != nil || string(content) != "application/epub+zip" {
+		v.report("PKG-007", "mimetype", 0, "mimetype file should only contain the string \"application/epub+zip\"")
+	}
+}
+
+func (v *validator) checkContainer() (string, bool) {
+	const name = "META-INF/container.xml"
+	content, err := v.reader.read(name)
+	if err != nil {
+		v.report("RSC-002", name, 0, "required META-INF/container.xml resource could not be found")
+		return "", false
+	}
+	var container epubContainer
+	if err := xml.Unmarshal(content, &container); err != nil {
+		v.report("RSC-016", name, syntaxErrorLine(err), "fatal error while parsing file: %s", err)
+		return "", false
+	}
+	if len(container.Rootfiles) == 0 || container.Rootfiles[0].FullPath == "" {
+		v.report("RSC-003", name, 0, "no rootfile with media type \"application/oebps-package+xml\" was found")
+		return "", false
+	}
+	return container.Rootfiles[0].FullPath, true
+}
+
+func (v *validator) checkPackage(opfPath string) {
+	v.reader.baseDir = path.Dir(opfPath)
+	content, err := v.reader.read(opfPath)
+	if err != nil {
+		v.report("RSC-001", opfPath, 0, "file %q could not be found", opfPath)
+		return
+	}
+	if v.checkXML(opfPath, content, nil) == nil {
+		return
+	}
+	var opf opfPackage
+	if err := xml.Unmarshal(content, &opf); err != nil {
+		v.report("RSC-016", opfPath, syntaxErrorLine(err), "fatal error while parsing file: %s", err)
+		return
+	}
+
+	items := make(map[string]opfItem)
+	for _, item := range opf.Manifest {
+		items[item.Id] = item
+		name := v.reader.resolve(item.Href)
+		if _, ok := v.manifest[name]; ok {
+			v.report("OPF-074", opfPath, 0, "package resource %q is declared in several manifest items", item.Href)
+		}
+		v.manifest[name] = item
+		v.checkMediaType(opfPath, item)
+	}
+
+	for _, itemref := range opf.Spine.Itemrefs {
+		if _, ok := items[itemref.Idref]; !ok {
+			v.report("OPF-049", opfPath, 0, "item id %q was not found in the manifest", itemref.Idref)
+		}
+	}
+	if opf.Spine.Toc != "" {
+		if _, ok := items[opf.Spine.Toc]; !ok {
+			v.report("OPF-049", opfPath, 0, "item id %q was not found in the manifest", opf.Spine.Toc)
+		}
+	}
+
+	// check the content documents in a stable order
+	names := make([]string, 0, len(v.manifest))
+	for name := range v.manifest {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		item := v.manifest[name]
+		content, err := v.reader.read(name)
+		if err != nil {
+			v.report("RSC-001", opfPath, 0, "file %q could not be found", item.Href)
+			continue
+		}
+		switch item.MediaType {
+		case "application/xhtml+xml":
+			v.checkXML(name, content, v.checkReference)
+			v.checkProperties(opfPath, item, string(content))
+		case "application/x-dtbncx+xml", "image/svg+xml":
+			v.checkXML(name, content, v.checkReference)
+		}
+	}
+}
+
+// checkProperties compares the mathml and svg properties of a content
+// document with the elements it contains
+func (v *validator) checkProperties(opfPath string, item opfItem, content string) {
+	found := chapterProperties(content)
+	for _, property := range []string{"mathml", "svg"} {
+		switch contains, declared := hasProperty(found, property), hasProperty(item.Properties, property); {
+		case contains && !declared:
+			v.report("OPF-014", opfPath, 0, "the property %q should be declared in the OPF file for %q", property, item.Href)
+		case declared && !contains:
+			v.report("OPF-015", opfPath, 0, "the property %q should not be declared in the OPF file for %q", property, item.Href)
+		}
+	}
+}
+
+// checkMediaType compares the declared media type with the file extension
+func (v *validator) checkMediaType(opfPath string, item opfItem) {
+	if _, _, err := mime.ParseMediaType(item.MediaType); err != nil {
+		v.report("OPF-012", opfPath, 0, "invalid media type %q for %q", item.MediaType, item.Href)
+		return
+	}
+	expected := extensionMediaTypes[strings.ToLower(path.Ext(item.Href))]
+	if expected != "" && expected != item.MediaType {
+		v.report("OPF-029", opfPath, 0, "the file %q does not appear to match the media type %s", item.Href, item.MediaType)
+	}
+}
+
+var extensionMediaTypes = map[string]string{
+	".xhtml": "application/xhtml+xml",
+	".html":  "application/xhtml+xml",
+	".ncx":   "application/x-dtbncx+xml",
+	".css":   "text/css",
+	".jpg":   "image/jpeg",
+	".jpeg":  "image/jpeg",
+	".png":   "image/png",
+	".gif":   "image/gif",
+	".svg":   "image/svg+xml",
+}
+
+// checkXML reports when a document is not well-formed or repeats an id and
+// passes every href and src attribute to checkRef. It returns the ids, or
+// nil when the document could not be parsed.
+func (v *validator) checkXML(name string, content []byte, checkRef func(name string, line int, ref string)) map[string]bool {
+	ids := make(map[string]bool)
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.Strict = true
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return ids
+		}
+		if err != nil {
+			v.report("RSC-016", name, syntaxErrorLine(err), "fatal error while parsing file: %s", err)
+			return nil
+		}
+
+		element, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		line := lineAt(content, decoder.InputOffset())
+		for _, attr := range element.Attr {
+			switch {
+			case attr.Name.Local == "id" && (attr.Name.Space == "" || attr.Name.Space == "xml"):
+				if ids[attr.Value] {
+					v.report("RSC-005", name, line, "duplicate id %q", attr.Value)
+				}
+				ids[attr.Value] = true
+			case checkRef != nil && (attr.Name.Local == "href" || attr.Name.Local == "src"):
+				checkRef(name, line, attr.Value)
+			}
+		}
+	}
+}
+
+// checkReference reports references to files missing from the archive or
+// the manifest, remote and fragment-only references are fine
+func (v *validator) checkReference(name string, line int, ref string) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		v.report("RSC-020", name, line, "%q is not a valid URL", ref)
+		return
+	}
+	if u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return
+	}
+
+	target := path.Join(path.Dir(name), u.Path)
+	if _, ok := v.reader.files[target]; !ok {
+		v.report("RSC-007", name, line, "referenced resource %q could not be found in the EPUB", ref)
+		return
+	}
+	if _, ok := v.manifest[target]; !ok {
+		v.report("RSC-008", name, line, "referenced resource %q is not declared in the OPF manifest", ref)
+	}
+}
+
+func syntaxErrorLine(err error) int {
+	if syntax, ok := err.(*xml.SyntaxError); ok {
+		return syntax.Line
+	}
+	return 0
+}
+
+func lineAt(content []byte, offset int64) int {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	return bytes.Count(content[:offset], []byte("\n")) + 1
+}
@@ -0,0 +1,69 @@
+package ebook
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func validationCodes(messages []ValidationMessage) []string {
+	var codes []string
+	for _, m := range messages {
+		codes = append(codes, m.Code)
+	}
+	return codes
+}
+
+func TestValidateWrittenBook(t *testing.T) {
+	path := writeTestBook(t, JsonBook{
+		Title:      "Learning Go",
+		Uuid:       "9781449317904",
+		Language:   "en",
+		Author:     []string{"Jane Doe"},
+		Publisher:  []string{"O'Reilly Media, Inc."},
+		Stylesheet: "https://example.com/core.css",
+		Chapters: []Chapter{
+			{Id: "ch01", Filename: "ch01.html", Order: 1, Title: "One", Content: `<p id="a">Hello</p><img src="https://example.com/assets/gopher.jpg" alt="gopher">`, Images: []string{"assets/gopher.jpg"}},
+			{Id: "ch02", Filename: "ch02.html", Order: 2, Title: "Two", Content: `<p><a href="ch01.html#a">back</a></p>`},
+		},
+	})
+	defer os.RemoveAll(filepath.Dir(path))
+
+	messages, err := Validate(path)
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+}
+
+func TestValidateReportsBrokenBook(t *testing.T) {
+	path := writeTestEpub(t, map[string]string{
+		"META-INF/container.xml": `<container><rootfiles><rootfile full-path="content.opf"/></rootfiles></container>`,
+		"content.opf": `<package>
+<manifest>
+  <item id="a" href="a.xhtml" media-type="application/xhtml+xml"/>
+  <item id="b" href="b.xhtml" media-type="application/xhtml+xml"/>
+  <item id="img" href="cover.jpg" media-type="image/jpg"/>
+</manifest>
+<spine><itemref idref="a"/><itemref idref="missing"/></spine>
+</package>`,
+		"a.xhtml": `<html><body>
+<p id="x">one</p>
+<p id="x">two</p>
+<a href="c.xhtml">unlisted</a><a href="gone.xhtml#top">gone</a><a href="https://example.com">web</a>
+</body></html>`,
+		"b.xhtml":   `<html><body><p>unclosed</body></html>`,
+		"c.xhtml":   `<html/>`,
+		"cover.jpg": "",
+	})
+	defer os.RemoveAll(filepath.Dir(path))
+
+	messages, err := Validate(path)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"PKG-006", "OPF-029", "OPF-049", "RSC-005", "RSC-008", "RSC-007", "RSC-016"}, validationCodes(messages))
+	for _, m := range messages {
+		if m.Code == "RSC-005" {
+			assert.Equal(t, `ERROR(RSC-005): a.xhtml(3): duplicate id "x"`, m.String())
+		}
+	}
+}
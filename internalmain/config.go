@@ -0,0 +1,362 @@
+package internalmain
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kkc/safari-books-downloader/ebook"
+	"github.com/kkc/safari-books-downloader/utils"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	logrus "github.com/Sirupsen/logrus"
+)
+
+var profile string
+
+// kinds of config values
+const (
+	kindString   = "string"
+	kindInt      = "int"
+	kindDuration = "duration"
+)
+
+type configSetting struct {
+	kind     string
+	fallback interface{}
+	usage    string
+}
+
+// configSchema lists every key of ~/.safari.toml. All of them but the
+// profiles themselves can be overridden in a [profiles.<name>] section.
+var configSchema = map[string]configSetting{
+	"safari.username":     {kindString, "", "username of the SafariBooksOnline user"},
+	"safari.password":     {kindString, "", "password of the SafariBooksOnline user"},
+	"base_url":            {kindString, "", "url of the SafariBooksOnline site"},
+	"output.dir":          {kindString, "", "directory the epub files are saved to"},
+	"output.filename":     {kindString, "{{.Title}}.epub", "filename template of the epub file"},
+	"output.layout":       {kindString, "", "empty or library for Publisher/Author/Title.epub"},
+	"output.collision":    {kindString, "overwrite", "overwrite, skip or suffix an existing file"},
+	"concurrency":         {kindInt, 4, "number of chapters fetched at once"},
+	"retry.attempts":      {kindInt, 2, "how often a failed request is retried"},
+	"retry.backoff":       {kindDuration, "1s", "wait before the first retry, doubled on every retry"},
+	"format":              {kindString, "epub", "output format, only epub for now"},
+	"proxy":               {kindString, "", "http proxy url"},
+	"cache_dir":           {kindString, "books", "directory the books are assembled in"},
+	"library.index":       {kindString, "", "library index file, default is $HOME/.safari-library.json"},
+	"images.device":       {kindString, "", "optimize images for a device: kindle-paperwhite, kobo or tablet"},
+	"math.fallback":       {kindString, "", "replace MathML for readers without MathML support: alttext or svg"},
+	"code.theme":          {kindString, "", "highlight code listings with a light or dark theme"},
+	"style.theme":         {kindString, "", "stylesheet theme: default, publisher, minimal, large-type or dark"},
+	"style.css":           {kindString, "", "stylesheet file linked after all others"},
+	"style.accessibility": {kindString, "", "accessibility profile: dyslexia, high-contrast or dark-mode"},
+	"audit.format":        {kindString, "", "write an accessibility report next to the book: text or json"},
+}
+
+var supportedFormats = []string{"epub"}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "show, change or validate the config file",
+}
+
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "print the effective configuration",
+	Args:  cobra.NoArgs,
+	Run:   ShowConfig,
+}
+
+var configSetCmd = &cobra.Command{
+	Use:   "set key value",
+	Short: "set a key in the config file, e.g. set profiles.work.output.dir ~/books",
+	Args:  cobra.ExactArgs(2),
+	Run:   SetConfig,
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "check the config file for unknown keys and invalid values",
+	Args:  cobra.NoArgs,
+	Run:   ValidateConfig,
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.safari.toml)")
+	rootCmd.PersistentFlags().StringVar(&profile, "profile", "", "use the settings of the [profiles.<name>] config section")
+
+	configCmd.AddCommand(configShowCmd, configSetCmd, configValidateCmd)
+	rootCmd.AddCommand(configCmd)
+}
+
+func setConfigDefaults() {
+	for key, setting := range configSchema {
+		viper.SetDefault(key, setting.fallback)
+	}
+}
+
+// profileKey is where key of the named profile is stored, the top level
+// is the profile without name
+func profileKey(name string, key string) string {
+	if name == "" {
+		return key
+	}
+	return "profiles." + strings.ToLower(name) + "." + key
+}
+
+// profileConfigKey returns the key of the named profile when it overrides key
+func profileConfigKey(name string, key string) string {
+	if name != "" && viper.IsSet(profileKey(name, key)) {
+		return profileKey(name, key)
+	}
+	return key
+}
+
+// configKey returns the key of the active profile when it overrides key
+func configKey(key string) string {
+	return profileConfigKey(profile, key)
+}
+
+func configString(key string) string {
+	return profileString(profile, key)
+}
+
+func configInt(key string) int {
+	return profileInt(profile, key)
+}
+
+func configDuration(key string) time.Duration {
+	return profileDuration(profile, key)
+}
+
+func profileString(name string, key string) string {
+	return viper.GetString(profileConfigKey(name, key))
+}
+
+func profileInt(name string, key string) int {
+	return viper.GetInt(profileConfigKey(name, key))
+}
+
+func profileDuration(name string, key string) time.Duration {
+	return viper.GetDuration(profileConfigKey(name, key))
+}
+
+// configFilePath is the file config set writes to
+func configFilePath() (string, error) {
+	if cfgFile != "" {
+		return cfgFile, nil
+	}
+	if used := viper.ConfigFileUsed(); used != "" {
+		return used, nil
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".safari.toml"), nil
+}
+
+// schemaKey strips the profile prefix off a key
+func schemaKey(key string) (string, string) {
+	if !strings.HasPrefix(key, "profiles.") {
+		return "", key
+	}
+	parts := strings.SplitN(key, ".", 3)
+	if len(parts) < 3 {
+		return "", key
+	}
+	return parts[1], parts[2]
+}
+
+func validateValue(key string, value interface{}) error {
+	_, name := schemaKey(key)
+	setting, ok := configSchema[name]
+	if !ok {
+		return fmt.Errorf("%s: unknown key", key)
+	}
+
+	s := fmt.Sprint(value)
+	switch setting.kind {
+	case kindInt:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a number", key, s)
+		}
+		if name == "concurrency" && n < 1 || n < 0 {
+			return fmt.Errorf("%s: %d is out of range", key, n)
+		}
+	case kindDuration:
+		if _, err := time.ParseDuration(s); err != nil {
+			return fmt.Errorf("%s: %q is not a duration like 500ms or 2s", key, s)
+		}
+	}
+
+	switch name {
+	case "format":
+		for _, format := range supportedFormats {
+			if s == format {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: unsupported format %q, expected one of %s", key, s, strings.Join(supportedFormats, ", "))
+	case "output.layout":
+		if s != "" && s != ebook.LibraryLayout {
+			return fmt.Errorf("%s: unsupported layout %q, expected %s", key, s, ebook.LibraryLayout)
+		}
+	case "output.collision":
+		if s != ebook.CollisionOverwrite && s != ebook.CollisionSkip && s != ebook.CollisionSuffix {
+			return fmt.Errorf("%s: unsupported policy %q, expected overwrite, skip or suffix", key, s)
+		}
+	case "images.device":
+		if s == "" {
+			return nil
+		}
+		if _, err := ebook.ImagePreset(s); err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+	case "style.theme":
+		if s == "" {
+			return nil
+		}
+		if err := ebook.CheckTheme(s); err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+	case "style.accessibility":
+		if s == "" {
+			return nil
+		}
+		if _, err := ebook.AccessibilityPreset(s); err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+	case "audit.format":
+		if s == "" {
+			return nil
+		}
+		if err := ebook.CheckAuditFormat(s); err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+	case "code.theme":
+		if s == "" {
+			return nil
+		}
+		if err := ebook.CheckCodeTheme(s); err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+	case "math.fallback":
+		for _, fallback := range append(ebook.MathFallbacks(), ebook.MathFallbackNone) {
+			if s == fallback {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: unsupported fallback %q, expected %s", key, s, strings.Join(ebook.MathFallbacks(), " or "))
+	case "proxy", "base_url":
+		if s == "" {
+			return nil
+		}
+		if u, err := url.Parse(s); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("%s: %q is not a url", key, s)
+		}
+	}
+	return nil
+}
+
+// validateConfig checks every key set in v
+func validateConfig(v *viper.Viper) []error {
+	var errs []error
+	keys := v.AllKeys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := validateValue(key, v.Get(key)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func ShowConfig(cmd *cobra.Command, args []string) {
+	if used := viper.ConfigFileUsed(); used != "" {
+		fmt.Println("# " + used)
+	}
+	if profile != "" {
+		fmt.Println("# profile " + profile)
+	}
+
+	var keys []string
+	for key := range configSchema {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := configString(key)
+		if key == "safari.password" && value != "" {
+			value = "[REDACTED]"
+		}
+		fmt.Printf("%s = %q\n", key, value)
+	}
+}
+
+// writeConfigValue stores one key in the config file, leaving the defaults
+// and environment out of it
+func writeConfigValue(key string, value string) error {
+	if err := validateValue(key, value); err != nil {
+		return err
+	}
+	path, err := configFilePath()
+	if err != nil {
+		return err
+	}
+
+	v := viper.New()
+	v.SetConfigFile(path)
+	if _, err := os.Stat(path); err == nil {
+		if err := v.ReadInConfig(); err != nil {
+			return err
+		}
+	}
+
+	_, name := schemaKey(key)
+	if configSchema[name].kind == kindInt {
+		n, _ := strconv.Atoi(value)
+		v.Set(key, n)
+	} else {
+		v.Set(key, value)
+	}
+	if err := v.WriteConfigAs(path); err != nil {
+		return err
+	}
+	// keep the running config in sync
+	viper.Set(key, value)
+	return nil
+}
+
+func SetConfig(cmd *cobra.Command, args []string) {
+	key := strings.ToLower(args[0])
+	utils.StopOnErr(writeConfigValue(key, args[1]))
+	logrus.Info("updated " + key)
+}
+
+func ValidateConfig(cmd *cobra.Command, args []string) {
+	path, err := configFilePath()
+	utils.StopOnErr(err)
+
+	v := viper.New()
+	v.SetConfigFile(path)
+	utils.StopOnErr(v.ReadInConfig())
+
+	errs := validateConfig(v)
+	for _, err := range errs {
+		logrus.Error(err)
+	}
+	if len(errs) > 0 {
+		os.Exit(-1)
+	}
+	fmt.Println(path + " is valid")
+}
@@ -0,0 +1,78 @@
+package internalmain
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateConfig(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("toml")
+	err := v.ReadConfig(bytes.NewBufferString(`
+concurrency = 0
+format = "pdf"
+proxy = "localhost"
+colour = "blue"
+
+[retry]
+attempts = 3
+backoff = "soon"
+
+[output]
+dir = "~/books"
+
+[audit]
+format = "html"
+
+[images]
+device = "kindle"
+
+[math]
+fallback = "png"
+
+[style]
+theme = "sepia"
+accessibility = "large"
+
+[profiles.work.output]
+dir = "~/work-books"
+
+[profiles.work]
+concurrency = "many"
+`))
+	assert.NoError(t, err)
+
+	var messages []string
+	for _, err := range validateConfig(v) {
+		messages = append(messages, err.Error())
+	}
+	assert.Equal(t, []string{
+		"audit.format: unknown audit format html, expected text or json",
+		"colour: unknown key",
+		"concurrency: 0 is out of range",
+		`format: unsupported format "pdf", expected one of epub`,
+		"images.device: unknown device kindle, expected one of kindle-paperwhite, kobo, tablet",
+		`math.fallback: unsupported fallback "png", expected alttext or svg`,
+		`profiles.work.concurrency: "many" is not a number`,
+		`proxy: "localhost" is not a url`,
+		`retry.backoff: "soon" is not a duration like 500ms or 2s`,
+		"style.accessibility: unknown accessibility profile large, expected one of dark-mode, dyslexia, high-contrast",
+		"style.theme: unknown theme sepia, expected one of dark, default, large-type, minimal, publisher",
+	}, messages)
+}
+
+func TestConfigKeyUsesProfile(t *testing.T) {
+	defer viper.Reset()
+	defer func() { profile = "" }()
+
+	viper.Set("output.dir", "books")
+	viper.Set("profiles.work.output.dir", "work-books")
+
+	assert.Equal(t, "books", configString("output.dir"))
+	profile = "Work"
+	assert.Equal(t, "work-books", configString("output.dir"))
+	assert.Equal(t, "output.filename", configKey("output.filename"))
+}
@@ -0,0 +1,124 @@
+package internalmain
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kkc/safari-books-downloader/credentials"
+	"github.com/kkc/safari-books-downloader/utils"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	logrus "github.com/Sirupsen/logrus"
+)
+
+var passwordFile string
+var passwordCommand string
+var credentialsFile string
+
+var credentialsCmd = &cobra.Command{
+	Use:   "credentials",
+	Short: "manage the encrypted credentials file",
+}
+
+var credentialsSaveCmd = &cobra.Command{
+	Use:   "save",
+	Short: "store username and password in the passphrase-encrypted credentials file",
+	Args:  cobra.NoArgs,
+	Run:   SaveCredentials,
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&passwordFile, "password-file", "", "read the password from the first line of this file")
+	rootCmd.PersistentFlags().StringVar(&passwordCommand, "password-command", "", "run this command and use the first line of its output as password")
+	rootCmd.PersistentFlags().StringVar(&credentialsFile, "credentials-file", "", "passphrase-encrypted credentials file (default is $HOME/.safari.credentials.age)")
+
+	credentialsCmd.AddCommand(credentialsSaveCmd)
+	rootCmd.AddCommand(credentialsCmd)
+}
+
+// credentialsFilePath is the encrypted credentials file of the named
+// profile, --credentials-file only applies to the active one
+func credentialsFilePath(name string) string {
+	if credentialsFile != "" && name == profile {
+		return credentialsFile
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return ""
+	}
+	if name == "" {
+		return filepath.Join(home, ".safari.credentials.age")
+	}
+	return filepath.Join(home, ".safari.credentials."+strings.ToLower(name)+".age")
+}
+
+// passphrase for the credentials file, from SAFARI_CREDENTIALS_PASSPHRASE
+// or the terminal
+func passphrase(path string) func() (string, error) {
+	return func() (string, error) {
+		if value := os.Getenv("SAFARI_CREDENTIALS_PASSPHRASE"); value != "" {
+			return value, nil
+		}
+		if !credentials.IsInteractive() {
+			return "", errors.New("the credentials file needs a passphrase, set SAFARI_CREDENTIALS_PASSPHRASE")
+		}
+		return credentials.PromptSecret("Passphrase for " + path + ": ")
+	}
+}
+
+// resolveCredentials looks up username and password of the named profile.
+// For the active profile the order of precedence is: flags,
+// --password-file, --password-command, SAFARI_USERNAME and SAFARI_PASSWORD,
+// the encrypted credentials file, the config file and finally an
+// interactive prompt. Fallback profiles only use the last three.
+func resolveCredentials(name string) (credentials.Credentials, error) {
+	var providers []credentials.Provider
+	if name == profile {
+		providers = append(providers,
+			credentials.Static{Source: "flags", Username: username, Password: password},
+			credentials.PasswordFile{Path: passwordFile},
+			credentials.PasswordCommand{Command: passwordCommand},
+			credentials.Env{},
+		)
+	}
+
+	path := credentialsFilePath(name)
+	providers = append(providers,
+		credentials.EncryptedFile{Path: path, Passphrase: passphrase(path)},
+		credentials.Static{
+			Source:   "config file",
+			Username: viper.GetString(profileKey(name, "safari.username")),
+			Password: viper.GetString(profileKey(name, "safari.password")),
+		},
+		credentials.Prompt{},
+	)
+
+	result, err := credentials.Resolve(providers...)
+	utils.RegisterSecret(result.Password)
+	return result, err
+}
+
+func SaveCredentials(cmd *cobra.Command, args []string) {
+	if !credentials.IsInteractive() {
+		utils.StopOnErr(errors.New("credentials save needs a terminal"))
+	}
+
+	result, err := credentials.Prompt{}.Credentials(credentials.Credentials{Username: username})
+	utils.StopOnErr(err)
+	secret, err := credentials.PromptSecret("New passphrase: ")
+	utils.StopOnErr(err)
+	confirm, err := credentials.PromptSecret("Repeat passphrase: ")
+	utils.StopOnErr(err)
+	if secret == "" || secret != confirm {
+		utils.StopOnErr(errors.New("passphrases are empty or do not match"))
+	}
+
+	path := credentialsFilePath(profile)
+	utils.StopOnErr(credentials.WriteEncryptedFile(path, result, secret))
+	logrus.Info("credentials saved to " + path)
+}
@@ -0,0 +1,43 @@
+package internalmain
+
+import (
+	"errors"
+	"os"
+
+	"github.com/kkc/safari-books-downloader/ebook"
+	"github.com/kkc/safari-books-downloader/utils"
+
+	"github.com/spf13/cobra"
+)
+
+var diffFormat string
+
+var diffCmd = &cobra.Command{
+	Use:   "diff old.epub new.epub",
+	Short: "show the chapters changed between two downloads of a book",
+	Args:  cobra.ExactArgs(2),
+	Run:   DiffBooks,
+}
+
+func init() {
+	diffCmd.Flags().StringVar(&diffFormat, "format", "text", "output format: text for a unified diff or html for a report")
+	rootCmd.AddCommand(diffCmd)
+}
+
+func DiffBooks(cmd *cobra.Command, args []string) {
+	if diffFormat != "text" && diffFormat != "html" {
+		utils.StopOnErr(errors.New("invalid diff format " + diffFormat + ", expected text or html"))
+	}
+
+	old, err := ebook.Open(args[0])
+	utils.StopOnErr(err)
+	updated, err := ebook.Open(args[1])
+	utils.StopOnErr(err)
+
+	diff := ebook.Diff(old, updated)
+	if diffFormat == "html" {
+		utils.StopOnErr(ebook.WriteHTML(os.Stdout, diff))
+		return
+	}
+	utils.StopOnErr(ebook.WriteUnified(os.Stdout, diff))
+}
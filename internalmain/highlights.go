@@ -0,0 +1,100 @@
+package internalmain
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/kkc/safari-books-downloader/ebook"
+	"github.com/kkc/safari-books-downloader/utils"
+
+	"github.com/spf13/cobra"
+
+	logrus "github.com/Sirupsen/logrus"
+)
+
+var highlightsFormat string
+var highlightsFile string
+var embedHighlights bool
+
+var highlightsCmd = &cobra.Command{
+	Use:   "highlights bookId",
+	Short: "export your highlights and notes of a book",
+	Args:  cobra.ExactArgs(1),
+	Run:   ExportHighlights,
+}
+
+func init() {
+	highlightsCmd.Flags().StringVar(&highlightsFormat, "format", "markdown", "export format: markdown or json")
+	highlightsCmd.Flags().StringVar(&highlightsFile, "export-file", "", "file the highlights are written to (default stdout)")
+	highlightsCmd.Flags().BoolVar(&embedHighlights, "embed", false, "download the book with the highlights marked and a My Notes chapter")
+	rootCmd.AddCommand(highlightsCmd)
+}
+
+func ExportHighlights(cmd *cobra.Command, args []string) {
+	if highlightsFormat != "markdown" && highlightsFormat != "json" {
+		utils.StopOnErr(errors.New("invalid highlights format " + highlightsFormat + ", expected markdown or json"))
+	}
+	// the export and the json progress of the download would share stdout
+	if embedHighlights && highlightsFile == "" && progressMode == "json" {
+		utils.StopOnErr(errors.New("--embed with --progress json needs --export-file"))
+	}
+	id := args[0]
+	progress, err := utils.NewProgress(progressMode)
+	utils.StopOnErr(err)
+	options, err := newBookOptions(cmd.Flags())
+	utils.StopOnErr(err)
+
+	accounts := make(map[string]*account)
+	a, err := profileAccount(accounts, profile, nil, progress)
+	utils.StopOnErr(err)
+	meta, err := a.meta(id)
+	utils.StopOnErr(err)
+	annotations, err := a.annotations(id)
+	utils.StopOnErr(err)
+
+	highlights := ebook.Highlights{Title: meta.Title, LastRead: meta.LastChapterRead.Title}
+	for _, annotation := range annotations {
+		highlights.Highlights = append(highlights.Highlights, ebook.Highlight{
+			Chapter:      annotation.Chapter,
+			ChapterTitle: annotation.ChapterTitle,
+			Text:         annotation.Highlight,
+			Note:         annotation.Note,
+			Created:      annotation.Created,
+		})
+	}
+	logrus.WithFields(logrus.Fields{
+		"BookId":     id,
+		"Highlights": len(highlights.Highlights),
+	}).Info("Fetch highlights")
+
+	utils.StopOnErr(writeHighlights(highlights))
+	if !embedHighlights {
+		return
+	}
+
+	result, _, err := a.fetch(id, nil)
+	utils.StopOnErr(err)
+	options.highlights = highlights.Highlights
+	outputOptions := newOutputOptions(cmd.Flags())
+	saveBook(openLibrary(), id, a, result, nil, options, progress, func(e *ebook.Ebook) (string, bool, error) {
+		return e.OutputPath(outputOptions)
+	})
+}
+
+// writeHighlights exports to --export-file or stdout
+func writeHighlights(highlights ebook.Highlights) error {
+	var w io.Writer = os.Stdout
+	if highlightsFile != "" {
+		f, err := os.Create(highlightsFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if highlightsFormat == "json" {
+		return ebook.WriteHighlightsJSON(w, highlights)
+	}
+	return ebook.WriteHighlightsMarkdown(w, highlights)
+}
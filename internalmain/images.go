@@ -0,0 +1,67 @@
+package internalmain
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/kkc/safari-books-downloader/ebook"
+
+	"github.com/spf13/pflag"
+)
+
+var device string
+var maxImageSize int
+var grayscale bool
+var jpegQuality int
+var pngToJPEG bool
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&device, "device", "", "optimize images for a device: "+strings.Join(ebook.ImagePresets(), ", "))
+	rootCmd.PersistentFlags().IntVar(&maxImageSize, "max-image-size", 0, "downscale images larger than this many pixels")
+	rootCmd.PersistentFlags().BoolVar(&grayscale, "grayscale", false, "convert images to grayscale")
+	rootCmd.PersistentFlags().IntVar(&jpegQuality, "jpeg-quality", 0, "recompress JPEG images at this quality, 1-100")
+	rootCmd.PersistentFlags().BoolVar(&pngToJPEG, "png-to-jpeg", false, "convert PNG images without transparency to JPEG")
+}
+
+// imageOptions starts from the --device preset and applies the image flags
+// on top, nil when no image processing was asked for
+func imageOptions(flags *pflag.FlagSet) (*ebook.ImageOptions, error) {
+	var options ebook.ImageOptions
+	enabled := false
+
+	if name := flagOrConfig(flags, "device", "images.device"); name != "" {
+		preset, err := ebook.ImagePreset(name)
+		if err != nil {
+			return nil, err
+		}
+		options = preset
+		enabled = true
+	}
+	if flags.Changed("max-image-size") {
+		if maxImageSize < 0 {
+			return nil, errors.New("--max-image-size must not be negative")
+		}
+		options.MaxDimension = maxImageSize
+		enabled = true
+	}
+	if flags.Changed("grayscale") {
+		options.Grayscale = grayscale
+		enabled = true
+	}
+	if flags.Changed("jpeg-quality") {
+		if jpegQuality < 1 || jpegQuality > 100 {
+			return nil, errors.New("--jpeg-quality must be between 1 and 100")
+		}
+		options.JPEGQuality = jpegQuality
+		enabled = true
+	}
+	if flags.Changed("png-to-jpeg") {
+		options.PNGToJPEG = pngToJPEG
+		enabled = true
+	}
+
+	if !enabled {
+		return nil, nil
+	}
+	return &options, nil
+}
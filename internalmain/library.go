@@ -0,0 +1,213 @@
+package internalmain
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kkc/safari-books-downloader/ebook"
+	"github.com/kkc/safari-books-downloader/library"
+	"github.com/kkc/safari-books-downloader/safari"
+	"github.com/kkc/safari-books-downloader/utils"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+
+	logrus "github.com/Sirupsen/logrus"
+)
+
+var libraryCmd = &cobra.Command{
+	Use:   "library",
+	Short: "list downloaded books and refresh the ones updated upstream",
+}
+
+var libraryListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the downloaded books",
+	Args:  cobra.NoArgs,
+	Run:   ListLibrary,
+}
+
+var libraryCheckUpdatesCmd = &cobra.Command{
+	Use:   "check-updates",
+	Short: "list the downloaded books that were updated upstream",
+	Args:  cobra.NoArgs,
+	Run:   CheckLibraryUpdates,
+}
+
+var libraryRefreshCmd = &cobra.Command{
+	Use:   "refresh",
+	Short: "download the books that were updated upstream again",
+	Args:  cobra.NoArgs,
+	Run:   RefreshLibrary,
+}
+
+func init() {
+	libraryCmd.AddCommand(libraryListCmd, libraryCheckUpdatesCmd, libraryRefreshCmd)
+	rootCmd.AddCommand(libraryCmd)
+}
+
+// libraryPath is the index file, $HOME/.safari-library.json by default
+func libraryPath() (string, error) {
+	if path := configString("library.index"); path != "" {
+		return homedir.Expand(path)
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".safari-library.json"), nil
+}
+
+func openLibrary() *library.Index {
+	path, err := libraryPath()
+	utils.StopOnErr(err)
+	index, err := library.Open(path)
+	utils.StopOnErr(err)
+	return index
+}
+
+// recordDownload adds a saved book to the library index
+func recordDownload(index *library.Index, id string, a *account, e *ebook.Ebook, path string, selection *library.Selection) {
+	book := e.Metadata()
+	if absolute, err := filepath.Abs(path); err == nil {
+		path = absolute
+	}
+	index.Record(library.Entry{
+		Id:           id,
+		Title:        book.Title,
+		Authors:      book.Author,
+		Isbn:         book.Isbn,
+		Path:         path,
+		Profile:      a.name,
+		DownloadedAt: time.Now().UTC(),
+		Updated:      book.Updated,
+		LastModified: book.LastModified,
+		Selection:    selection,
+	})
+	if err := index.Save(); err != nil {
+		logrus.Warn("could not update the library index: " + err.Error())
+	}
+}
+
+func ListLibrary(cmd *cobra.Command, args []string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTITLE\tAUTHORS\tDOWNLOADED\tPATH")
+	for _, entry := range openLibrary().List() {
+		title := entry.Title
+		if entry.Selection != nil {
+			title += " (" + entry.Selection.String() + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", entry.Id, title, strings.Join(entry.Authors, ", "), entry.DownloadedAt.Format("2006-01-02"), entry.Path)
+	}
+	w.Flush()
+}
+
+// updatedEntries compares every entry with fresh metadata, using the
+// profile the book was downloaded with
+func updatedEntries(index *library.Index, accounts map[string]*account, progress utils.ProgressReporter) []library.Entry {
+	var updated []library.Entry
+	for _, entry := range index.List() {
+		a, err := profileAccount(accounts, entry.Profile, nil, progress)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"BookId": entry.Id,
+			}).Warn("could not check for updates: " + err.Error())
+			continue
+		}
+
+		meta, err := a.meta(entry.Id)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"BookId": entry.Id,
+			}).Warn("could not check for updates: " + err.Error())
+			continue
+		}
+		if entry.NeedsUpdate(meta.Updated, meta.LastModifiedTime) {
+			updated = append(updated, entry)
+		}
+	}
+	return updated
+}
+
+func CheckLibraryUpdates(cmd *cobra.Command, args []string) {
+	accounts := make(map[string]*account)
+	updated := updatedEntries(openLibrary(), accounts, utils.NopProgress)
+	for _, entry := range updated {
+		fmt.Printf("%s\t%s\n", entry.Id, entry.Title)
+	}
+	if len(updated) == 0 {
+		logrus.Info("all books are up to date")
+	}
+}
+
+func RefreshLibrary(cmd *cobra.Command, args []string) {
+	progress, err := utils.NewProgress(progressMode)
+	utils.StopOnErr(err)
+	options, err := newBookOptions(cmd.Flags())
+	utils.StopOnErr(err)
+
+	index := openLibrary()
+	accounts := make(map[string]*account)
+	entries := make(map[string]library.Entry)
+	var ids []string
+	for _, entry := range updatedEntries(index, accounts, progress) {
+		entries[entry.Id] = entry
+		ids = append(ids, entry.Id)
+	}
+	failed := eachBook(ids, func(id string) error {
+		entry := entries[id]
+		logrus.WithFields(logrus.Fields{
+			"BookId": entry.Id,
+		}).Info("Refresh Book")
+
+		a, err := profileAccount(accounts, entry.Profile, nil, progress)
+		if err != nil {
+			return err
+		}
+		// partial downloads are refreshed with the same chapters
+		a.safari.SelectChapters(nil)
+		if entry.Selection != nil {
+			selector, err := safari.NewChapterSelector(entry.Selection.Chapters, entry.Selection.TocMatch)
+			if err != nil {
+				return err
+			}
+			a.safari.SelectChapters(selector)
+		}
+		previous := previousSnapshot(entry.Id)
+		result, snapshot, err := a.fetch(entry.Id, previous)
+		if err != nil {
+			return err
+		}
+		if saveBook(index, entry.Id, a, result, entry.Selection, options, progress, func(e *ebook.Ebook) (string, bool, error) {
+			return entry.Path, false, nil
+		}) {
+			saveSnapshot(entry.Id, previous, snapshot)
+		}
+		return nil
+	})
+	utils.StopOnErr(failedBooksError(failed))
+}
+
+// saveBook writes a fetched book to the path picked by outputPath and
+// records it in the library with the chapter selection it was fetched
+// with. It returns false when the book was skipped.
+func saveBook(index *library.Index, id string, a *account, result []byte, selection *library.Selection, options bookOptions, progress utils.ProgressReporter, outputPath func(*ebook.Ebook) (string, bool, error)) bool {
+	e := ebook.NewEbookWithCacheDir(result, configString("cache_dir"))
+	output, skip, err := outputPath(e)
+	utils.StopOnErr(err)
+	if skip {
+		logrus.Info(output + " exists, skipping book " + id)
+		return false
+	}
+	e.SetProgress(progress)
+	e.SetFetcher(a.safari)
+	e.SetConcurrency(profileInt(a.name, "concurrency"))
+	options.apply(e)
+	e.Save(output)
+	recordDownload(index, id, a, e, output, selection)
+	return true
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 
+	"github.com/kkc/safari-books-downloader/library"
 	"github.com/kkc/safari-books-downloader/safari"
 
 	"github.com/kkc/safari-books-downloader/ebook"
@@ -13,6 +15,7 @@ import (
 
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 
 	logrus "github.com/Sirupsen/logrus"
@@ -23,17 +26,32 @@ var bookId string
 var username string
 var password string
 var output string
+var outputDir string
+var layout string
+var collision string
+var chapters string
+var tocMatch string
+var incremental bool
+var markExternalLinks bool
+var popupFootnotes bool
+var progressMode string
+var logLevel string
+var logFormat string
+var quiet bool
+var verbose bool
 
 var rootCmd = &cobra.Command{
-	Use:   "safari-downloader bookId",
-	Short: "safari-downloader bookId",
+	Use:   "safari-downloader bookId [bookId...]",
+	Short: "safari-downloader bookId [bookId...]",
 	Args: func(cmd *cobra.Command, args []string) error {
 		if len(args) < 1 {
 			return errors.New("requires bookId")
 		}
-		_, err := strconv.Atoi(args[0])
-		if err != nil {
-			return fmt.Errorf("invalid bookid specified: %s", args[0])
+		for _, arg := range args {
+			_, err := strconv.Atoi(arg)
+			if err != nil {
+				return fmt.Errorf("invalid bookid specified: %s", arg)
+			}
 		}
 		return nil
 	},
@@ -42,12 +60,29 @@ var rootCmd = &cobra.Command{
 
 // define flags and handle configuration here (cobra)
 func init() {
-	cobra.OnInitialize(initConfig)
-	//rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.safari.toml)")
+	cobra.OnInitialize(initLogging, initConfig)
 	//rootCmd.PersistentFlags().StringVarP(&bookId, "bookid", "b", "", "the book id of the SafariBooksOnline ePub to be generated")
 	rootCmd.PersistentFlags().StringVarP(&username, "username", "u", "", "username of the SafariBooksOnline user - must have a **paid/trial membership**, otherwise will not be able to access the books")
 	rootCmd.PersistentFlags().StringVarP(&password, "password", "p", "", "password of the SafariBooksOnline user")
-	rootCmd.PersistentFlags().StringVarP(&output, "output", "o", "ebook.epub", "output path the epub file should be saved to")
+	rootCmd.PersistentFlags().StringVarP(&output, "output", "o", "", "output path the epub file should be saved to, a template over {{.Title}}, {{.Authors}}, {{.Isbn}}, {{.Publisher}} and {{.Issued}} (default \"{{.Title}}.epub\")")
+	rootCmd.PersistentFlags().StringVar(&outputDir, "output-dir", "", "directory the output path is relative to")
+	rootCmd.PersistentFlags().StringVar(&layout, "layout", "", "set to library to save books as Publisher/Author/Title.epub")
+	rootCmd.PersistentFlags().StringVar(&collision, "on-collision", "", "what to do when the output file exists: overwrite, skip or suffix (default \"overwrite\")")
+	rootCmd.PersistentFlags().StringVar(&chapters, "chapters", "", "only download the given chapters, e.g. 3-7,12")
+	rootCmd.PersistentFlags().StringVar(&tocMatch, "toc-match", "", "only download chapters whose TOC label matches the pattern")
+	rootCmd.PersistentFlags().BoolVar(&incremental, "incremental", false, "only fetch the chapters changed since the last download of the book")
+	rootCmd.PersistentFlags().BoolVar(&popupFootnotes, "popup-footnotes", false, "turn footnotes into EPUB 3 notes that readers show as popups")
+	rootCmd.PersistentFlags().BoolVar(&markExternalLinks, "mark-external-links", false, "add class=\"external\" to links leading out of the book")
+	rootCmd.PersistentFlags().StringVar(&progressMode, "progress", "auto", "progress output: auto, bar, json or none")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "log level: debug, info, warn or error")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "log format: text or json")
+	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "only log errors")
+	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "log debug output")
+}
+
+// initLogging sets up the log level, format and redaction of secrets.
+func initLogging() {
+	utils.StopOnErr(utils.ConfigureLogging(logLevel, logFormat, quiet, verbose))
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -57,46 +92,147 @@ func initConfig() {
 		viper.SetConfigFile(cfgFile)
 	} else {
 		home, err := homedir.Dir()
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
+		utils.StopOnErr(err)
 
 		viper.AddConfigPath(home)
 		viper.SetConfigName(".safari")
 	}
 
+	setConfigDefaults()
 	viper.AutomaticEnv() // read in environment variables that match
+	viper.BindEnv("safari.username", "SAFARI_USERNAME")
+	viper.BindEnv("safari.password", "SAFARI_PASSWORD")
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+		logrus.Info("Using config file: " + viper.ConfigFileUsed())
+	} else if cfgFile != "" {
+		utils.StopOnErr(err)
 	}
 }
 
 func DownloadSafariBook(cmd *cobra.Command, args []string) {
 	flags := cmd.Flags()
 
-	//bookid := flags.Lookup("bookid").Value.String()
-	bookId = args[0]
-	logrus.WithFields(logrus.Fields{
-		"BookId": bookId,
-	}).Info("Fetch Book")
-	username = flags.Lookup("username").Value.String()
-	password := flags.Lookup("password").Value.String()
-	output := flags.Lookup("output").Value.String()
-
-	if username == "" {
-		username = viper.GetString("safari.username")
-	}
-	if password == "" {
-		password = viper.GetString("safari.password")
+	outputOptions := newOutputOptions(flags)
+	utils.StopOnErr(validateValue("format", configString("format")))
+
+	selector, err := safari.NewChapterSelector(chapters, tocMatch)
+	utils.StopOnErr(err)
+	var selection *library.Selection
+	if chapters == "" && tocMatch == "" {
+		selector = nil
+	} else {
+		selection = &library.Selection{Chapters: chapters, TocMatch: tocMatch}
 	}
-	safari := safari.NewSafari()
-	result, err := safari.FetchBookById(bookId, username, password)
+	progress, err := utils.NewProgress(progressMode)
 	utils.StopOnErr(err)
-	ebook := ebook.NewEbook(result)
-	ebook.Save(output)
+	options, err := newBookOptions(flags)
+	utils.StopOnErr(err)
+
+	index := openLibrary()
+	accounts := make(map[string]*account)
+	failed := eachBook(args, func(id string) error {
+		logrus.WithFields(logrus.Fields{
+			"BookId": id,
+		}).Info("Fetch Book")
+		if path, skip := skipBeforeFetch(accounts, id, outputOptions, selector, progress); skip {
+			logrus.Info(path + " exists, skipping book " + id)
+			return nil
+		}
+		var previous *safari.Snapshot
+		if incremental {
+			previous = previousSnapshot(id)
+		}
+		result, snapshot, a, err := fetchWithFallback(accounts, id, previous, selector, progress)
+		if err != nil {
+			return err
+		}
+		if saveBook(index, id, a, result, selection, options, progress, func(e *ebook.Ebook) (string, bool, error) {
+			return e.OutputPath(outputOptions)
+		}) {
+			saveSnapshot(id, previous, snapshot)
+		}
+		return nil
+	})
+	utils.StopOnErr(failedBooksError(failed))
+}
+
+// eachBook downloads the books one after another. A book that fails is
+// logged and the next one is tried, the failed ids are returned.
+func eachBook(ids []string, download func(id string) error) []string {
+	var failed []string
+	for _, id := range ids {
+		if err := download(id); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"BookId": id,
+			}).Error("could not download book: " + err.Error())
+			failed = append(failed, id)
+		}
+	}
+	return failed
+}
+
+// failedBooksError lists the books eachBook could not download, nil when
+// all of them were downloaded
+func failedBooksError(failed []string) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	return errors.New(strconv.Itoa(len(failed)) + " books failed: " + strings.Join(failed, ", "))
+}
+
+// skipBeforeFetch resolves the output path from the metadata of the book,
+// so books skipped by the collision policy cost one request. Errors are
+// left to the fetch, which tries the fallback profiles.
+func skipBeforeFetch(accounts map[string]*account, id string, options ebook.OutputOptions, selector *safari.ChapterSelector, progress utils.ProgressReporter) (string, bool) {
+	if options.Collision != ebook.CollisionSkip {
+		return "", false
+	}
+	a, err := profileAccount(accounts, profile, selector, progress)
+	if err != nil {
+		return "", false
+	}
+	meta, err := a.meta(id)
+	if err != nil {
+		return "", false
+	}
+	path, skip, err := ebook.BookOutputPath(metaBook(meta), options)
+	if err != nil {
+		return "", false
+	}
+	return path, skip
+}
+
+// metaBook holds the fields of the metadata that the output path uses, like
+// the book built by the fetch
+func metaBook(meta safari.Meta) ebook.JsonBook {
+	book := ebook.JsonBook{Title: meta.Title, Isbn: meta.Isbn, Issued: meta.Issued}
+	for _, author := range meta.Authors {
+		book.Author = append(book.Author, author.Name)
+	}
+	for _, publisher := range meta.Publishers {
+		book.Publisher = append(book.Publisher, publisher.Name)
+	}
+	return book
+}
+
+// newOutputOptions reads the flags that pick where books are saved
+func newOutputOptions(flags *pflag.FlagSet) ebook.OutputOptions {
+	return ebook.OutputOptions{
+		Template:  flagOrConfig(flags, "output", "output.filename"),
+		Dir:       flagOrConfig(flags, "output-dir", "output.dir"),
+		Layout:    flagOrConfig(flags, "layout", "output.layout"),
+		Collision: flagOrConfig(flags, "on-collision", "output.collision"),
+	}
+}
+
+// flagOrConfig prefers the flag when it was given on the command line
+func flagOrConfig(flags *pflag.FlagSet, name string, key string) string {
+	if flags.Changed(name) {
+		return flags.Lookup(name).Value.String()
+	}
+	return configString(key)
 }
 
 func Main() {
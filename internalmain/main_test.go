@@ -0,0 +1,46 @@
+package internalmain
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kkc/safari-books-downloader/ebook"
+	"github.com/kkc/safari-books-downloader/safari"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetaBookOutputPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "Node.js in Action.epub"), nil, 0644))
+
+	var meta safari.Meta
+	assert.NoError(t, json.Unmarshal([]byte(`{"title": "Node.js in Action", "authors": [{"name": "Mike Cantelon"}], "publishers": [{"name": "Manning"}]}`), &meta))
+	book := metaBook(meta)
+	assert.Equal(t, []string{"Mike Cantelon"}, book.Author)
+	assert.Equal(t, []string{"Manning"}, book.Publisher)
+
+	path, skip, err := ebook.BookOutputPath(book, ebook.OutputOptions{Template: "{{.Title}}", Dir: dir, Collision: ebook.CollisionSkip})
+	assert.NoError(t, err)
+	assert.True(t, skip)
+	assert.Equal(t, filepath.Join(dir, "Node.js in Action.epub"), path)
+}
+
+func TestEachBookContinuesAfterFailures(t *testing.T) {
+	var tried []string
+	failed := eachBook([]string{"1", "2", "3"}, func(id string) error {
+		tried = append(tried, id)
+		if id == "2" {
+			return safari.ErrBookNotAvailable
+		}
+		return nil
+	})
+	assert.Equal(t, []string{"1", "2", "3"}, tried)
+	assert.Equal(t, []string{"2"}, failed)
+	assert.EqualError(t, failedBooksError(failed), "1 books failed: 2")
+	assert.NoError(t, failedBooksError(nil))
+}
@@ -0,0 +1,13 @@
+package internalmain
+
+import (
+	"strings"
+
+	"github.com/kkc/safari-books-downloader/ebook"
+)
+
+var mathFallback string
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&mathFallback, "math-fallback", "", "replace MathML for readers without MathML support: "+strings.Join(ebook.MathFallbacks(), " or "))
+}
@@ -0,0 +1,115 @@
+package internalmain
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/kkc/safari-books-downloader/ebook"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/pflag"
+)
+
+var codeTheme string
+var wrapCode bool
+var styleTheme string
+var userCSS string
+var noPublisherCSS bool
+var accessibility string
+var auditFormat string
+var altFromCaption bool
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&styleTheme, "theme", "", "stylesheet theme: "+strings.Join(ebook.Themes(), ", ")+" (default \"default\")")
+	rootCmd.PersistentFlags().StringVar(&userCSS, "css", "", "stylesheet file linked after all others")
+	rootCmd.PersistentFlags().BoolVar(&noPublisherCSS, "no-publisher-css", false, "leave out the stylesheet of the publisher")
+	rootCmd.PersistentFlags().StringVar(&accessibility, "accessibility", "", "accessibility profile: "+strings.Join(ebook.AccessibilityPresets(), ", "))
+	rootCmd.PersistentFlags().StringVar(&auditFormat, "audit", "", "write an accessibility report next to the book: "+strings.Join(ebook.AuditFormats(), " or "))
+	rootCmd.PersistentFlags().BoolVar(&altFromCaption, "alt-from-caption", false, "use figure captions as alt text of images without one")
+	rootCmd.PersistentFlags().StringVar(&codeTheme, "code-theme", "", "highlight code listings with a "+strings.Join(ebook.CodeThemes(), " or ")+" theme")
+	rootCmd.PersistentFlags().BoolVar(&wrapCode, "wrap-code", false, "wrap long lines of highlighted code listings on narrow screens")
+}
+
+// bookOptions are the settings applied to every saved book
+type bookOptions struct {
+	images         *ebook.ImageOptions
+	mathFallback   string
+	popupFootnotes bool
+	code           *ebook.CodeOptions
+	style          ebook.StyleOptions
+	accessibility  *ebook.AccessibilityProfile
+	audit          *ebook.AuditOptions
+	// highlights are set per book by the highlights command
+	highlights []ebook.Highlight
+}
+
+// newBookOptions reads the flags that change how books are written
+func newBookOptions(flags *pflag.FlagSet) (bookOptions, error) {
+	images, err := imageOptions(flags)
+	if err != nil {
+		return bookOptions{}, err
+	}
+	fallback := flagOrConfig(flags, "math-fallback", "math.fallback")
+	if err := validateValue("math.fallback", fallback); err != nil {
+		return bookOptions{}, err
+	}
+	options := bookOptions{images: images, mathFallback: fallback, popupFootnotes: popupFootnotes}
+
+	if theme := flagOrConfig(flags, "code-theme", "code.theme"); theme != "" {
+		if err := ebook.CheckCodeTheme(theme); err != nil {
+			return bookOptions{}, err
+		}
+		options.code = &ebook.CodeOptions{Theme: theme, Wrap: wrapCode}
+	}
+
+	options.style = ebook.StyleOptions{
+		Theme:          flagOrConfig(flags, "theme", "style.theme"),
+		UserCSS:        flagOrConfig(flags, "css", "style.css"),
+		StripPublisher: noPublisherCSS,
+	}
+	if err := validateValue("style.theme", options.style.Theme); err != nil {
+		return bookOptions{}, err
+	}
+	if options.style.UserCSS != "" {
+		path, err := homedir.Expand(options.style.UserCSS)
+		if err != nil {
+			return bookOptions{}, err
+		}
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			return bookOptions{}, errors.New("stylesheet " + options.style.UserCSS + " is not a file")
+		}
+		options.style.UserCSS = path
+	}
+
+	if name := flagOrConfig(flags, "accessibility", "style.accessibility"); name != "" {
+		profile, err := ebook.AccessibilityPreset(name)
+		if err != nil {
+			return bookOptions{}, err
+		}
+		options.accessibility = &profile
+	}
+
+	format := flagOrConfig(flags, "audit", "audit.format")
+	if format != "" {
+		if err := ebook.CheckAuditFormat(format); err != nil {
+			return bookOptions{}, err
+		}
+	}
+	if format != "" || altFromCaption {
+		options.audit = &ebook.AuditOptions{Format: format, CaptionAlt: altFromCaption}
+	}
+	return options, nil
+}
+
+// apply hands the options to an ebook before it is saved
+func (o bookOptions) apply(e *ebook.Ebook) {
+	e.SetImageOptions(o.images)
+	e.SetMathFallback(o.mathFallback)
+	e.SetPopupFootnotes(o.popupFootnotes)
+	e.SetCodeOptions(o.code)
+	e.SetStyleOptions(o.style)
+	e.SetAccessibility(o.accessibility)
+	e.SetAuditOptions(o.audit)
+	e.SetHighlights(o.highlights)
+}
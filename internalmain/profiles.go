@@ -0,0 +1,190 @@
+package internalmain
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/kkc/safari-books-downloader/credentials"
+	"github.com/kkc/safari-books-downloader/safari"
+	"github.com/kkc/safari-books-downloader/utils"
+
+	homedir "github.com/mitchellh/go-homedir"
+
+	logrus "github.com/Sirupsen/logrus"
+)
+
+var fallbackProfiles []string
+
+func init() {
+	rootCmd.PersistentFlags().StringSliceVar(&fallbackProfiles, "fallback-profile", nil, "profiles to try in order when a book is not available with --profile")
+}
+
+// account is a profile with its own Safari instance and access token
+type account struct {
+	name   string
+	safari *safari.Safari
+	// storedToken is the content of the token file
+	storedToken string
+}
+
+func profileOptions(name string) safari.Options {
+	return safari.Options{
+		Concurrency:       profileInt(name, "concurrency"),
+		Retries:           profileInt(name, "retry.attempts"),
+		RetryBackoff:      profileDuration(name, "retry.backoff"),
+		Proxy:             profileString(name, "proxy"),
+		BaseURL:           profileString(name, "base_url"),
+		MarkExternalLinks: markExternalLinks,
+	}
+}
+
+func newAccount(name string, selector *safari.ChapterSelector, progress utils.ProgressReporter) (*account, error) {
+	s := safari.NewSafari()
+	if selector != nil {
+		s.SelectChapters(selector)
+	}
+	s.SetProgress(progress)
+	if err := s.SetOptions(profileOptions(name)); err != nil {
+		return nil, err
+	}
+	// credentials and tokens belong to one profile, they are never inherited
+	token, err := credentials.ReadToken(tokenFilePath(name))
+	if err != nil {
+		logrus.Warn("could not read the stored access token: " + err.Error())
+	}
+	if token != "" {
+		s.SetAccessToken(token)
+	}
+	return &account{name: name, safari: s, storedToken: token}, nil
+}
+
+// tokenFilePath is the file the access token of the named profile is kept
+// in, apart from the config file so it can stay private
+func tokenFilePath(name string) string {
+	home, err := homedir.Dir()
+	if err != nil {
+		return ""
+	}
+	if name == "" {
+		return filepath.Join(home, ".safari.token")
+	}
+	return filepath.Join(home, ".safari.token."+strings.ToLower(name))
+}
+
+// withLogin runs call, logging in only when there is no stored token or
+// the stored one expired. A new token is written to the token file of the
+// profile.
+func (a *account) withLogin(call func(username string, password string) error) error {
+	var login credentials.Credentials
+	var err error
+	if a.safari.AccessToken() == "" {
+		login, err = resolveCredentials(a.name)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = call(login.Username, login.Password)
+	if err == safari.ErrUnauthorized && login.Username == "" {
+		logrus.Info("stored access token of profile " + a.displayName() + " expired, logging in again")
+		a.safari.SetAccessToken("")
+		login, err = resolveCredentials(a.name)
+		if err != nil {
+			return err
+		}
+		err = call(login.Username, login.Password)
+	}
+	if err != nil {
+		return err
+	}
+
+	if token := a.safari.AccessToken(); token != a.storedToken {
+		if err := credentials.WriteToken(tokenFilePath(a.name), token); err != nil {
+			logrus.Warn("could not store the access token: " + err.Error())
+		} else {
+			a.storedToken = token
+		}
+	}
+	return nil
+}
+
+// fetch downloads a book, reusing the unchanged chapters of previous
+func (a *account) fetch(id string, previous *safari.Snapshot) ([]byte, *safari.Snapshot, error) {
+	var result []byte
+	var snapshot *safari.Snapshot
+	err := a.withLogin(func(username string, password string) error {
+		var err error
+		result, snapshot, err = a.safari.FetchBookIncremental(id, username, password, previous)
+		return err
+	})
+	return result, snapshot, err
+}
+
+// meta fetches the metadata of a book
+func (a *account) meta(id string) (safari.Meta, error) {
+	var meta safari.Meta
+	err := a.withLogin(func(username string, password string) error {
+		var err error
+		meta, err = a.safari.FetchMeta(id, username, password)
+		return err
+	})
+	return meta, err
+}
+
+// annotations fetches the highlights of the user in a book
+func (a *account) annotations(id string) ([]safari.Annotation, error) {
+	var annotations []safari.Annotation
+	err := a.withLogin(func(username string, password string) error {
+		var err error
+		annotations, err = a.safari.FetchAnnotations(id, username, password)
+		return err
+	})
+	return annotations, err
+}
+
+// profileAccount returns the account of the named profile, creating it on
+// first use
+func profileAccount(accounts map[string]*account, name string, selector *safari.ChapterSelector, progress utils.ProgressReporter) (*account, error) {
+	if a, ok := accounts[name]; ok {
+		return a, nil
+	}
+	a, err := newAccount(name, selector, progress)
+	if err != nil {
+		return nil, err
+	}
+	accounts[name] = a
+	return a, nil
+}
+
+func (a *account) displayName() string {
+	if a.name == "" {
+		return "default"
+	}
+	return a.name
+}
+
+// fetchWithFallback tries the active profile first and then the fallback
+// profiles for books missing from a subscription. It returns the account
+// the book was fetched with.
+func fetchWithFallback(accounts map[string]*account, id string, previous *safari.Snapshot, selector *safari.ChapterSelector, progress utils.ProgressReporter) ([]byte, *safari.Snapshot, *account, error) {
+	var err error
+	for _, name := range append([]string{profile}, fallbackProfiles...) {
+		var a *account
+		a, err = profileAccount(accounts, name, selector, progress)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		var result []byte
+		var snapshot *safari.Snapshot
+		result, snapshot, err = a.fetch(id, previous)
+		if err != safari.ErrBookNotAvailable {
+			return result, snapshot, a, err
+		}
+		logrus.WithFields(logrus.Fields{
+			"BookId":  id,
+			"Profile": a.displayName(),
+		}).Warn("book is not available, trying the next profile")
+	}
+	return nil, nil, nil, err
+}
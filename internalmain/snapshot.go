@@ -0,0 +1,50 @@
+package internalmain
+
+import (
+	"path/filepath"
+
+	"github.com/kkc/safari-books-downloader/safari"
+
+	logrus "github.com/Sirupsen/logrus"
+)
+
+// snapshotPath is where the chapters of the last download of a book are
+// kept, next to the book in the cache dir
+func snapshotPath(id string) string {
+	return filepath.Join(configString("cache_dir"), id+".snapshot.json")
+}
+
+// previousSnapshot loads the snapshot of the last download, a missing or
+// unreadable snapshot downloads the whole book
+func previousSnapshot(id string) *safari.Snapshot {
+	snapshot, err := safari.LoadSnapshot(snapshotPath(id))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"BookId": id,
+		}).Warn("could not read the last snapshot, downloading the whole book: " + err.Error())
+		return nil
+	}
+	return snapshot
+}
+
+// saveSnapshot logs the changelog against previous and keeps snapshot for
+// the next download. stdout is left to the --progress=json events.
+func saveSnapshot(id string, previous *safari.Snapshot, snapshot *safari.Snapshot) {
+	if previous != nil {
+		changes := snapshot.Changes(previous)
+		for _, change := range changes {
+			logrus.WithFields(logrus.Fields{
+				"BookId":   id,
+				"Change":   change.Kind,
+				"Filename": change.Filename,
+			}).Info(change.Title)
+		}
+		if len(changes) == 0 {
+			logrus.Info("no chapters changed since the last download")
+		}
+	}
+
+	if err := snapshot.Save(snapshotPath(id)); err != nil {
+		logrus.Warn("could not save the snapshot: " + err.Error())
+	}
+}
@@ -0,0 +1,41 @@
+package internalmain
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/kkc/safari-books-downloader/ebook"
+	"github.com/kkc/safari-books-downloader/utils"
+
+	"github.com/spf13/cobra"
+)
+
+var validateCmd = &cobra.Command{
+	Use:   "validate file.epub [file.epub...]",
+	Short: "check epub files for problems that crash readers",
+	Args:  cobra.MinimumNArgs(1),
+	Run:   ValidateBooks,
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
+
+func ValidateBooks(cmd *cobra.Command, args []string) {
+	invalid := false
+	for _, path := range args {
+		messages, err := ebook.Validate(path)
+		utils.StopOnErr(err)
+		for _, message := range messages {
+			fmt.Println(path + ": " + message.String())
+		}
+		if len(messages) > 0 {
+			invalid = true
+			continue
+		}
+		fmt.Println(path + " is valid")
+	}
+	if invalid {
+		os.Exit(-1)
+	}
+}
@@ -0,0 +1,130 @@
+package library
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is one downloaded book
+type Entry struct {
+	Id           string    `json:"id"`
+	Title        string    `json:"title"`
+	Authors      []string  `json:"authors"`
+	Isbn         string    `json:"isbn,omitempty"`
+	Path         string    `json:"path"`
+	Profile      string    `json:"profile,omitempty"`
+	DownloadedAt time.Time `json:"downloaded_at"`
+	Updated      time.Time `json:"updated"`
+	LastModified time.Time `json:"last_modified"`
+	// Selection is set for books downloaded with only some chapters
+	Selection *Selection `json:"selection,omitempty"`
+}
+
+// Selection is the --chapters and --toc-match of a partial download
+type Selection struct {
+	Chapters string `json:"chapters,omitempty"`
+	TocMatch string `json:"toc_match,omitempty"`
+}
+
+func (s Selection) String() string {
+	var parts []string
+	if s.Chapters != "" {
+		parts = append(parts, "chapters "+s.Chapters)
+	}
+	if s.TocMatch != "" {
+		parts = append(parts, "toc matching "+s.TocMatch)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// NeedsUpdate reports whether the upstream timestamps are newer than the
+// ones recorded for the download
+func (e Entry) NeedsUpdate(updated time.Time, lastModified time.Time) bool {
+	return updated.After(e.Updated) || lastModified.After(e.LastModified)
+}
+
+// Index is the JSON file listing every downloaded book by id
+type Index struct {
+	path  string
+	books map[string]Entry
+	sync.Mutex
+}
+
+// Open reads the index at path, a missing file is an empty index
+func Open(path string) (*Index, error) {
+	index := &Index{
+		path:  path,
+		books: make(map[string]Entry),
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		index.books[entry.Id] = entry
+	}
+	return index, nil
+}
+
+// Get returns the entry of a book id
+func (i *Index) Get(id string) (Entry, bool) {
+	i.Lock()
+	defer i.Unlock()
+	entry, ok := i.books[id]
+	return entry, ok
+}
+
+// Record adds or replaces the entry of a book
+func (i *Index) Record(entry Entry) {
+	i.Lock()
+	defer i.Unlock()
+	i.books[entry.Id] = entry
+}
+
+// List returns all entries sorted by title
+func (i *Index) List() []Entry {
+	i.Lock()
+	defer i.Unlock()
+
+	entries := make([]Entry, 0, len(i.books))
+	for _, entry := range i.books {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		return strings.ToLower(entries[a].Title) < strings.ToLower(entries[b].Title)
+	})
+	return entries
+}
+
+// Save writes the index, replacing the old file only once the new one is
+// complete
+func (i *Index) Save() error {
+	content, err := json.MarshalIndent(i.List(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(i.path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := i.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, i.path)
+}
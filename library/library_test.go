@@ -0,0 +1,55 @@
+package library
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "library")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "nested", "library.json")
+	index, err := Open(path)
+	assert.NoError(t, err)
+	assert.Empty(t, index.List())
+
+	downloaded := time.Date(2018, 4, 12, 13, 48, 12, 0, time.UTC)
+	index.Record(Entry{Id: "2", Title: "zebra", DownloadedAt: downloaded})
+	index.Record(Entry{Id: "1", Title: "Apple", Path: "apple.epub", DownloadedAt: downloaded, Selection: &Selection{Chapters: "3-7"}})
+	assert.NoError(t, index.Save())
+
+	index, err = Open(path)
+	assert.NoError(t, err)
+	entries := index.List()
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "Apple", entries[0].Title)
+		assert.Equal(t, "zebra", entries[1].Title)
+		assert.True(t, downloaded.Equal(entries[0].DownloadedAt))
+	}
+
+	entry, ok := index.Get("1")
+	assert.True(t, ok)
+	assert.Equal(t, "apple.epub", entry.Path)
+	if assert.NotNil(t, entry.Selection) {
+		assert.Equal(t, "chapters 3-7", entry.Selection.String())
+	}
+	entry, _ = index.Get("2")
+	assert.Nil(t, entry.Selection)
+}
+
+func TestEntryNeedsUpdate(t *testing.T) {
+	recorded := time.Date(2018, 4, 12, 0, 0, 0, 0, time.UTC)
+	entry := Entry{Updated: recorded, LastModified: recorded}
+
+	assert.False(t, entry.NeedsUpdate(recorded, recorded))
+	assert.False(t, entry.NeedsUpdate(recorded.Add(-time.Hour), recorded))
+	assert.True(t, entry.NeedsUpdate(recorded.Add(time.Hour), recorded))
+	assert.True(t, entry.NeedsUpdate(recorded, recorded.Add(time.Hour)))
+}
@@ -0,0 +1,92 @@
+package safari
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	logrus "github.com/Sirupsen/logrus"
+)
+
+// Annotation is a passage the user highlighted in a book, with the note
+// they wrote about it
+type Annotation struct {
+	ID           string
+	Chapter      string
+	ChapterTitle string
+	Highlight    string
+	Note         string
+	Created      time.Time
+}
+
+// annotationPage is one page of the annotations endpoint, next is empty on
+// the last page and may be relative to the page
+type annotationPage struct {
+	Count   int    `json:"count"`
+	Next    string `json:"next"`
+	Results []struct {
+		ID           json.Number `json:"id"`
+		Chapter      string      `json:"chapter"`
+		ChapterTitle string      `json:"chapter_title"`
+		Highlight    string      `json:"highlight"`
+		Annotation   string      `json:"annotation"`
+		CreatedTime  time.Time   `json:"created_time"`
+	} `json:"results"`
+}
+
+// FetchAnnotations returns the highlights and notes of the user in a book,
+// in the order the server lists them. The access token is only sent to the
+// API host and a page listed twice ends the listing.
+func (s *Safari) FetchAnnotations(id string, username string, password string) ([]Annotation, error) {
+	err := s.login(username, password)
+	if err != nil {
+		return nil, err
+	}
+	base, err := url.Parse(s.baseUrl + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	var annotations []Annotation
+	page := base.ResolveReference(&url.URL{Path: "api/v1/book/" + id + "/annotations/"})
+	seen := make(map[string]bool)
+	for {
+		if seen[page.String()] {
+			logrus.Warn("annotation page " + page.String() + " was already fetched, stopping")
+			break
+		}
+		seen[page.String()] = true
+		body, err := s.fetchURL(page.String(), page.Host == base.Host)
+		if status, ok := err.(*statusError); ok && (status.code == http.StatusForbidden || status.code == http.StatusNotFound) {
+			return nil, ErrBookNotAvailable
+		}
+		if err != nil {
+			return nil, err
+		}
+		var listing annotationPage
+		if err := json.Unmarshal(body, &listing); err != nil {
+			return nil, err
+		}
+		for _, result := range listing.Results {
+			annotations = append(annotations, Annotation{
+				ID:           result.ID.String(),
+				Chapter:      path.Base(strings.TrimSuffix(result.Chapter, "/")),
+				ChapterTitle: result.ChapterTitle,
+				Highlight:    result.Highlight,
+				Note:         result.Annotation,
+				Created:      result.CreatedTime,
+			})
+		}
+		if listing.Next == "" {
+			break
+		}
+		page, err = page.Parse(listing.Next)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return annotations, nil
+}
@@ -0,0 +1,75 @@
+package safari
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchAnnotationsFollowsPages(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.String() {
+		case "/api/v1/book/1/annotations/":
+			fmt.Fprintf(w, `{"count": 2, "next": "%s/api/v1/book/1/annotations/?page=2", "results": [
+				{"id": 7, "chapter": "%s/api/v1/book/1/chapter/ch01.html", "chapter_title": "Pods",
+				 "highlight": "A pod is a group of containers", "annotation": "remember this",
+				 "created_time": "2018-04-12T10:00:00Z"}]}`, server.URL, server.URL)
+		case "/api/v1/book/1/annotations/?page=2":
+			fmt.Fprint(w, `{"count": 3, "next": "?page=3", "results": [
+				{"id": 8, "chapter": "/api/v1/book/1/chapter/ch02.html/", "highlight": "Services"}]}`)
+		case "/api/v1/book/1/annotations/?page=3":
+			// a broken next link back to the first page
+			fmt.Fprint(w, `{"count": 3, "next": "/api/v1/book/1/annotations/", "results": [
+				{"id": 9, "chapter": "/api/v1/book/1/chapter/ch03.html", "highlight": "Volumes"}]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	s := NewSafari()
+	assert.NoError(t, s.SetOptions(Options{BaseURL: server.URL}))
+	s.SetAccessToken("token")
+
+	annotations, err := s.FetchAnnotations("1", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []Annotation{
+		{ID: "7", Chapter: "ch01.html", ChapterTitle: "Pods", Highlight: "A pod is a group of containers", Note: "remember this",
+			Created: time.Date(2018, 4, 12, 10, 0, 0, 0, time.UTC)},
+		{ID: "8", Chapter: "ch02.html", Highlight: "Services"},
+		{ID: "9", Chapter: "ch03.html", Highlight: "Volumes"},
+	}, annotations)
+
+	_, err = s.FetchAnnotations("2", "", "")
+	assert.Equal(t, ErrBookNotAvailable, err)
+}
+
+func TestFetchAnnotationsKeepsTokenOnApiHost(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Authorization"))
+		fmt.Fprint(w, `{"count": 2, "next": null, "results": [{"id": 8, "chapter": "ch02.html", "highlight": "Services"}]}`)
+	}))
+	defer other.Close()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		fmt.Fprintf(w, `{"count": 2, "next": "%s/annotations/?page=2", "results": [{"id": 7, "chapter": "ch01.html", "highlight": "Pods"}]}`, other.URL)
+	}))
+	defer api.Close()
+
+	s := NewSafari()
+	assert.NoError(t, s.SetOptions(Options{BaseURL: api.URL}))
+	s.SetAccessToken("token")
+
+	annotations, err := s.FetchAnnotations("1", "", "")
+	assert.NoError(t, err)
+	assert.Len(t, annotations, 2)
+}
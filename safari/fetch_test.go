@@ -0,0 +1,215 @@
+package safari
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kkc/safari-books-downloader/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// chapterUpdated is the timestamp of every chapter served by newFakeSafari
+var chapterUpdated = time.Date(2018, 4, 12, 0, 0, 0, 0, time.UTC)
+
+// newFakeSafari starts a server that serves books with the given number of
+// chapters and returns a Safari pointing at it.
+func newFakeSafari(t *testing.T, chapterCount int) (*Safari, *httptest.Server) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oauth2/access_token/" {
+			json.NewEncoder(w).Encode(AuthResponse{AccessToken: "token"})
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) < 4 || parts[0] != "api" || parts[2] != "book" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		id := parts[3]
+		if id == "forbidden" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		bookUrl := server.URL + "/api/v1/book/" + id
+
+		switch {
+		case len(parts) == 4:
+			meta := Meta{Identifier: id, Title: "Book " + id}
+			for i := 0; i < chapterCount; i++ {
+				meta.Chapters = append(meta.Chapters, fmt.Sprintf("%s/chapter/ch%03d.html", bookUrl, i))
+			}
+			json.NewEncoder(w).Encode(meta)
+		case parts[4] == "flat-toc":
+			var toc []TocContent
+			for i := 0; i < chapterCount; i += 2 {
+				toc = append(toc, TocContent{
+					URL:      fmt.Sprintf("%s/chapter/ch%03d.html", bookUrl, i),
+					ID:       fmt.Sprintf("toc%03d", i),
+					Filename: fmt.Sprintf("ch%03d.html", i),
+					Label:    fmt.Sprintf("Chapter %d", i),
+				})
+			}
+			json.NewEncoder(w).Encode(toc)
+		case parts[4] == "chapter":
+			var meta ChapterMeta
+			meta.Filename = parts[5]
+			meta.Title = "Title " + parts[5]
+			meta.Content = bookUrl + "/chapter-content/" + parts[5]
+			meta.Images = []interface{}{"assets/" + parts[5] + ".png"}
+			meta.Updated = chapterUpdated
+			meta.LastModifiedTime = chapterUpdated
+			json.NewEncoder(w).Encode(meta)
+		case parts[4] == "chapter-content":
+			fmt.Fprintf(w, "<p>%s of %s</p>", parts[5], id)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	s := NewSafari()
+	s.baseUrl = server.URL
+	return s, server
+}
+
+func TestFetchBookByIdConcurrently(t *testing.T) {
+	const chapterCount = 200
+	s, server := newFakeSafari(t, chapterCount)
+	defer server.Close()
+	s.concurrency = 64
+
+	var wg sync.WaitGroup
+	for b := 0; b < 8; b++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			data, err := s.FetchBookById(id, "user", "password")
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			var book jsonBook
+			assert.NoError(t, json.Unmarshal(data, &book))
+			assert.Equal(t, id, book.Uuid)
+			if assert.Len(t, book.Chapters, chapterCount) {
+				for i, chapter := range book.Chapters {
+					assert.Equal(t, i+1, chapter.Order)
+					assert.Equal(t, fmt.Sprintf("<p>ch%03d.html of %s</p>", i, id), chapter.Content)
+				}
+				assert.Equal(t, "toc000", book.Chapters[0].Id)
+				assert.Equal(t, "ch001.html", book.Chapters[1].Id)
+			}
+		}(fmt.Sprintf("978%d", b))
+	}
+	wg.Wait()
+}
+
+func TestFetchChaptersReportsErrors(t *testing.T) {
+	s, server := newFakeSafari(t, 3)
+	defer server.Close()
+
+	assert.NoError(t, s.authorizeUser("user", "password"))
+	assert.NoError(t, s.fetchMeta("1"))
+
+	book, _ := s.books.get("1")
+	book.meta.Chapters = append(book.meta.Chapters, server.URL+"/missing/ch.html")
+	progress := &recordingProgress{}
+	s.SetProgress(progress)
+	assert.Error(t, s.fetchChapters("1"))
+
+	// the failed chapter is not reported as done
+	done := 0
+	for _, event := range progress.events {
+		if event.Type == utils.ChapterDone {
+			done++
+			assert.True(t, event.Current < event.Total)
+		}
+	}
+	assert.Equal(t, 3, done)
+}
+
+type recordingProgress struct {
+	sync.Mutex
+	events []utils.ProgressEvent
+}
+
+func (r *recordingProgress) Report(event utils.ProgressEvent) {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, event)
+}
+
+func TestFetchBookByIdReportsProgress(t *testing.T) {
+	s, server := newFakeSafari(t, 5)
+	defer server.Close()
+	progress := &recordingProgress{}
+	s.SetProgress(progress)
+
+	_, err := s.FetchBookById("1", "user", "password")
+	assert.NoError(t, err)
+
+	var phases []string
+	chapters := 0
+	for _, event := range progress.events {
+		switch event.Type {
+		case utils.PhaseStart:
+			phases = append(phases, event.Phase)
+		case utils.ChapterDone:
+			chapters++
+			assert.Equal(t, 5, event.Total)
+		}
+	}
+	assert.Equal(t, []string{"login", "meta", "chapters"}, phases)
+	assert.Equal(t, 5, chapters)
+	assert.Equal(t, utils.PhaseFinish, progress.events[len(progress.events)-1].Type)
+}
+
+func TestFetchBookByIdWithStoredToken(t *testing.T) {
+	s, server := newFakeSafari(t, 1)
+	defer server.Close()
+
+	s.SetAccessToken("token")
+	_, err := s.FetchBookById("1", "", "")
+	assert.NoError(t, err)
+
+	_, err = s.FetchBookById("forbidden", "", "")
+	assert.Equal(t, ErrBookNotAvailable, err)
+
+	s.SetAccessToken("expired")
+	_, err = s.FetchBookById("1", "", "")
+	assert.Equal(t, ErrUnauthorized, err)
+}
+
+func TestFetchAssetSendsTokenOnlyToAPIHost(t *testing.T) {
+	s, server := newFakeSafari(t, 1)
+	defer server.Close()
+	assert.NoError(t, s.authorizeUser("user", "password"))
+
+	data, err := s.FetchAsset(server.URL + "/api/v1/book/1/chapter-content/cover.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "<p>cover.jpg of 1</p>", string(data))
+
+	var authorization string
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte("image"))
+	}))
+	defer cdn.Close()
+	data, err = s.FetchAsset(cdn.URL + "/cover.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "image", string(data))
+	assert.Empty(t, authorization)
+
+	_, err = s.FetchAsset("/missing/cover.jpg")
+	assert.Error(t, err)
+}
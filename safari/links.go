@@ -0,0 +1,210 @@
+package safari
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	logrus "github.com/Sirupsen/logrus"
+)
+
+var anchorHrefReg = regexp.MustCompile(`<a\s[^>]*>`)
+var hrefAttrReg = regexp.MustCompile(`\s+href="([^"]*)"`)
+var classAttrReg = regexp.MustCompile(`\s+class="([^"]*)"`)
+
+// DanglingLink is a link to a chapter that is not part of the epub
+type DanglingLink struct {
+	Chapter string
+	Link    string
+}
+
+// linkResolver maps the links of chapter content to the files of the epub.
+// A chapter is known by its filename and by the href, full path and url of
+// its TOC entries.
+type linkResolver struct {
+	bookId  string
+	baseUrl string
+	// included maps the known paths of the chapters in the epub to their filename
+	included map[string]string
+	// excluded holds the known paths of the chapters left out
+	excluded     map[string]bool
+	markExternal bool
+}
+
+// newLinkResolver collects the paths of the fetched chapters and of the
+// chapters the selector left out, the book must be locked
+func newLinkResolver(book *Book, baseUrl string, markExternal bool) *linkResolver {
+	r := &linkResolver{
+		bookId:       book.id,
+		baseUrl:      baseUrl,
+		included:     make(map[string]string),
+		excluded:     make(map[string]bool),
+		markExternal: markExternal,
+	}
+
+	byUrl := make(map[string]string)
+	for index, uri := range book.meta.Chapters {
+		if chapter, ok := book.chapters[index]; ok {
+			byUrl[uri] = chapter.Filename
+			r.add(chapter.Filename, chapter.Filename)
+			r.add(uri, chapter.Filename)
+		}
+	}
+	for filename := range book.excluded {
+		r.exclude(filename)
+	}
+	for uri, content := range book.toc {
+		filename, ok := byUrl[uri]
+		if !ok {
+			filename, ok = r.included[content.Filename]
+		}
+		for _, known := range []string{content.Href, content.FullPath, content.Filename, uri} {
+			if ok {
+				r.add(known, filename)
+			} else if book.excluded[content.Filename] {
+				r.exclude(known)
+			}
+		}
+	}
+	return r
+}
+
+func (r *linkResolver) add(known string, filename string) {
+	if known = linkPath(known); known != "" && filename != "" {
+		if _, ok := r.included[known]; !ok {
+			r.included[known] = filename
+		}
+	}
+}
+
+func (r *linkResolver) exclude(known string) {
+	if known = linkPath(known); known != "" {
+		r.excluded[known] = true
+	}
+}
+
+// linkPath drops the scheme, host and fragment of a link
+func linkPath(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(u.Path, "/")
+}
+
+// lookup matches the longest trailing part of a link path against the known
+// chapter paths, e.g. library/view/slug/id/ch03.html finds ch03.html
+func (r *linkResolver) lookup(linkPath string) (filename string, excluded bool, found bool) {
+	parts := strings.Split(linkPath, "/")
+	for i := range parts {
+		candidate := strings.Join(parts[i:], "/")
+		if filename, ok := r.included[candidate]; ok {
+			return filename, false, true
+		}
+		if r.excluded[candidate] {
+			return "", true, true
+		}
+	}
+	return "", false, false
+}
+
+// inBook reports whether an absolute or root relative link points into
+// this book on the Safari site
+func (r *linkResolver) inBook(u *url.URL) bool {
+	if !strings.Contains(u.Path, "/library/view/") && !strings.Contains(u.Path, "/api/v1/book/") {
+		return false
+	}
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == r.bookId {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve rewrites the anchors of one chapter. Links into the book become
+// Filename#fragment, links to chapters left out lose their href so the text
+// stays in place, other Safari pages become absolute and external links are
+// kept, with class="external" when marking is on.
+func (r *linkResolver) resolve(chapter string, content string) (string, []DanglingLink) {
+	var dangling []DanglingLink
+	content = anchorHrefReg.ReplaceAllStringFunc(content, func(anchor string) string {
+		match := hrefAttrReg.FindStringSubmatch(anchor)
+		if match == nil {
+			return anchor
+		}
+		href := match[1]
+		u, err := url.Parse(href)
+		if err != nil || href == "" || strings.HasPrefix(href, "#") {
+			return anchor
+		}
+
+		absolute := u.Scheme != "" || u.Host != "" || strings.HasPrefix(u.Path, "/")
+		if absolute && !r.inBook(u) {
+			if u.Scheme == "" && u.Host == "" {
+				href = r.baseUrl + u.String()
+				anchor = strings.Replace(anchor, match[0], ` href="`+href+`"`, 1)
+			}
+			if r.markExternal && (u.Scheme == "" || u.Scheme == "http" || u.Scheme == "https") {
+				anchor = markExternal(anchor)
+			}
+			return anchor
+		}
+
+		filename, excluded, found := r.lookup(strings.TrimPrefix(u.Path, "/"))
+		switch {
+		case found && !excluded:
+			target := filename
+			if u.Fragment != "" {
+				target += "#" + u.Fragment
+			}
+			return strings.Replace(anchor, match[0], ` href="`+target+`"`, 1)
+		case found || absolute || isChapterPath(u.Path):
+			dangling = append(dangling, DanglingLink{Chapter: chapter, Link: match[1]})
+			return strings.Replace(anchor, match[0], "", 1)
+		}
+		// a relative link to some other file of the book
+		return anchor
+	})
+	return content, dangling
+}
+
+func isChapterPath(p string) bool {
+	switch strings.ToLower(path.Ext(p)) {
+	case ".html", ".xhtml", ".htm":
+		return true
+	}
+	return false
+}
+
+func markExternal(anchor string) string {
+	if match := classAttrReg.FindStringSubmatch(anchor); match != nil {
+		return strings.Replace(anchor, match[0], ` class="`+strings.TrimSpace(match[1]+" external")+`"`, 1)
+	}
+	return strings.TrimSuffix(anchor, ">") + ` class="external">`
+}
+
+// resolveLinks rewrites the links of every fetched chapter and logs the
+// dangling ones, the book must be locked
+func (s *Safari) resolveLinks(book *Book) []DanglingLink {
+	r := newLinkResolver(book, s.baseUrl, s.markExternalLinks)
+	var dangling []DanglingLink
+	for index := range book.meta.Chapters {
+		chapter, ok := book.chapters[index]
+		if !ok {
+			continue
+		}
+		var found []DanglingLink
+		chapter.Content, found = r.resolve(chapter.Filename, chapter.Content)
+		book.chapters[index] = chapter
+		dangling = append(dangling, found...)
+	}
+	for _, link := range dangling {
+		logrus.WithFields(logrus.Fields{
+			"Chapter": link.Chapter,
+			"Link":    link.Link,
+		}).Warn("dangling link to a chapter not in the book")
+	}
+	return dangling
+}
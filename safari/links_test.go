@@ -0,0 +1,67 @@
+package safari
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLinkBook() *Book {
+	const bookUrl = "https://www.safaribooksonline.com/api/v1/book/9781491935675"
+	return &Book{
+		id: "9781491935675",
+		meta: Meta{Chapters: []string{
+			bookUrl + "/chapter/ch01.html",
+			bookUrl + "/chapter/ch02.html",
+		}},
+		chapters: map[int]Chapter{
+			0: {Filename: "ch01.html"},
+			1: {Filename: "ch02.html"},
+		},
+		toc: map[string]TocContent{
+			bookUrl + "/chapter/ch02.html": {Href: "Text/ch02.html#intro", FullPath: "OEBPS/Text/ch02.html", Filename: "ch02.html", Fragment: "intro"},
+			bookUrl + "/chapter/ch03.html": {Href: "Text/ch03.html", FullPath: "OEBPS/Text/ch03.html", Filename: "ch03.html"},
+		},
+		excluded: map[string]bool{"ch03.html": true},
+	}
+}
+
+func TestResolveLinksToChapters(t *testing.T) {
+	r := newLinkResolver(newTestLinkBook(), "https://www.safaribooksonline.com", false)
+
+	input := `<a href="/library/view/kubernetes-up-and/9781491935675/ch02.html#fig2-1">Figure 2-1</a>` +
+		` <a href="https://www.safaribooksonline.com/api/v1/book/9781491935675/chapter/ch01.html">Chapter 1</a>` +
+		` <a class="x" href="../Text/ch02.html">Chapter 2</a>` +
+		` <a href="#local">here</a>`
+	result, dangling := r.resolve("ch01.html", input)
+	assert.Equal(t, `<a href="ch02.html#fig2-1">Figure 2-1</a>`+
+		` <a href="ch01.html">Chapter 1</a>`+
+		` <a class="x" href="ch02.html">Chapter 2</a>`+
+		` <a href="#local">here</a>`, result)
+	assert.Empty(t, dangling)
+}
+
+func TestResolveLinksReportsDangling(t *testing.T) {
+	r := newLinkResolver(newTestLinkBook(), "https://www.safaribooksonline.com", false)
+
+	input := `<a href="ch03.html#fig3-1">Figure 3-1</a> <a href="/library/view/kubernetes-up-and/9781491935675/ch09.html">Chapter 9</a> <a href="examples/code.zip">code</a>`
+	result, dangling := r.resolve("ch02.html", input)
+	assert.Equal(t, `<a>Figure 3-1</a> <a>Chapter 9</a> <a href="examples/code.zip">code</a>`, result)
+	assert.Equal(t, []DanglingLink{
+		{Chapter: "ch02.html", Link: "ch03.html#fig3-1"},
+		{Chapter: "ch02.html", Link: "/library/view/kubernetes-up-and/9781491935675/ch09.html"},
+	}, dangling)
+}
+
+func TestResolveLinksKeepsExternal(t *testing.T) {
+	input := `<a href="https://kubernetes.io/docs/">docs</a> <a class="ulink" href="/library/view/other-book/9780000000000/ch01.html">other</a> <a href="mailto:a@example.com">mail</a>`
+
+	r := newLinkResolver(newTestLinkBook(), "https://www.safaribooksonline.com", false)
+	result, dangling := r.resolve("ch01.html", input)
+	assert.Equal(t, `<a href="https://kubernetes.io/docs/">docs</a> <a class="ulink" href="https://www.safaribooksonline.com/library/view/other-book/9780000000000/ch01.html">other</a> <a href="mailto:a@example.com">mail</a>`, result)
+	assert.Empty(t, dangling)
+
+	r.markExternal = true
+	result, _ = r.resolve("ch01.html", input)
+	assert.Equal(t, `<a href="https://kubernetes.io/docs/" class="external">docs</a> <a class="ulink external" href="https://www.safaribooksonline.com/library/view/other-book/9780000000000/ch01.html">other</a> <a href="mailto:a@example.com">mail</a>`, result)
+}
@@ -0,0 +1,91 @@
+package safari
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	logrus "github.com/Sirupsen/logrus"
+)
+
+// Options tune how a Safari instance talks to the server
+type Options struct {
+	// Concurrency is the number of chapters fetched at once
+	Concurrency int
+	// Retries is how often a failed request is retried
+	Retries int
+	// RetryBackoff is the wait before the first retry, doubled on every retry
+	RetryBackoff time.Duration
+	// Proxy is the url of an http proxy, empty uses the environment
+	Proxy string
+	// BaseURL of the SafariBooksOnline site, empty keeps the default
+	BaseURL string
+	// MarkExternalLinks adds class="external" to links leaving the book
+	MarkExternalLinks bool
+}
+
+// SetOptions applies options. A zero Concurrency, RetryBackoff, BaseURL or
+// Proxy keeps the default, Retries and MarkExternalLinks are applied as
+// given so 0 turns retries off.
+func (s *Safari) SetOptions(options Options) error {
+	if options.Concurrency < 0 || options.Retries < 0 || options.RetryBackoff < 0 {
+		return errors.New("concurrency, retries and retry backoff can not be negative")
+	}
+	if options.Concurrency > 0 {
+		s.concurrency = options.Concurrency
+	}
+	s.retries = options.Retries
+	s.markExternalLinks = options.MarkExternalLinks
+	if options.RetryBackoff > 0 {
+		s.retryBackoff = options.RetryBackoff
+	}
+
+	if options.BaseURL != "" {
+		base, err := url.Parse(options.BaseURL)
+		if err != nil || base.Scheme == "" || base.Host == "" {
+			return errors.New("invalid base url " + options.BaseURL)
+		}
+		s.baseUrl = strings.TrimSuffix(options.BaseURL, "/")
+	}
+
+	if options.Proxy != "" {
+		proxy, err := url.Parse(options.Proxy)
+		if err != nil {
+			return err
+		}
+		s.client = &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyURL(proxy)},
+		}
+	}
+	return nil
+}
+
+// do sends the request built by newRequest with the shared client. Network
+// errors, 429 and 5xx responses are retried with an exponential backoff.
+func (s *Safari) do(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	backoff := s.retryBackoff
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := s.client.Do(req)
+		retry := err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		if !retry || attempt >= s.retries {
+			return resp, err
+		}
+
+		if err == nil {
+			resp.Body.Close()
+		}
+		logrus.WithFields(logrus.Fields{
+			"Attempt": attempt + 1,
+			"Url":     req.URL.String(),
+		}).Warn("request failed, retrying")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
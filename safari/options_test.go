@@ -0,0 +1,51 @@
+package safari
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchResourceRetries(t *testing.T) {
+	failures := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures < 2 {
+			failures++
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	s := NewSafari()
+	s.baseUrl = server.URL
+	assert.NoError(t, s.SetOptions(Options{Retries: 1, RetryBackoff: time.Millisecond}))
+	_, err := s.fetchResource("resource")
+	assert.Error(t, err)
+
+	failures = 0
+	assert.NoError(t, s.SetOptions(Options{Retries: 2, RetryBackoff: time.Millisecond}))
+	body, err := s.fetchResource("resource")
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", body)
+}
+
+func TestSetOptionsValidation(t *testing.T) {
+	s := NewSafari()
+	assert.Error(t, s.SetOptions(Options{Concurrency: -1}))
+	assert.Error(t, s.SetOptions(Options{Proxy: "://broken"}))
+
+	assert.NoError(t, s.SetOptions(Options{Concurrency: 8, Proxy: "http://localhost:3128"}))
+	assert.Equal(t, 8, s.concurrency)
+	assert.NotNil(t, s.client.Transport)
+
+	// zero keeps the concurrency but turns retries off
+	assert.NoError(t, s.SetOptions(Options{Retries: 3}))
+	assert.NoError(t, s.SetOptions(Options{}))
+	assert.Equal(t, 8, s.concurrency)
+	assert.Equal(t, 0, s.retries)
+}
@@ -0,0 +1,83 @@
+package safari
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+)
+
+var invalidIdReg = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// orderChapters reconciles the fetched chapters with the flat TOC. Chapters
+// keep the reading order of meta.Chapters, get sequential play orders
+// starting at 1 and an id that is unique within the book. Chapters missing
+// from the TOC get an id derived from their filename.
+func orderChapters(urls []string, toc map[string]TocContent, fetched map[int]Chapter) []Chapter {
+	byFilename := make(map[string]TocContent)
+	for _, content := range toc {
+		if content.Filename == "" {
+			continue
+		}
+		if current, ok := byFilename[content.Filename]; !ok || content.Order < current.Order {
+			byFilename[content.Filename] = content
+		}
+	}
+
+	var chapters []Chapter
+	used := make(map[string]bool)
+	for index, uri := range urls {
+		chapter, ok := fetched[index]
+		if !ok {
+			continue
+		}
+
+		content, inToc := toc[uri]
+		if !inToc {
+			content, inToc = byFilename[chapter.Filename]
+		}
+
+		id := ""
+		if inToc {
+			id = sanitizeId(content.ID)
+		}
+		if id == "" {
+			filename := chapter.Filename
+			if filename == "" {
+				filename = path.Base(uri)
+			}
+			id = sanitizeId(filename)
+		}
+		if id == "" {
+			id = "chapter"
+		}
+
+		chapter.Id = uniqueId(id, used)
+		chapter.Order = len(chapters) + 1
+		chapters = append(chapters, chapter)
+	}
+
+	return chapters
+}
+
+// sanitizeId turns s into a valid XML id
+func sanitizeId(s string) string {
+	id := invalidIdReg.ReplaceAllString(s, "_")
+	if id == "" {
+		return ""
+	}
+	if c := id[0]; !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c == '_') {
+		id = "id_" + id
+	}
+	return id
+}
+
+// uniqueId skips the ids taken by other chapters, the ebook writer renames
+// chapters whose id the package manifest uses
+func uniqueId(id string, used map[string]bool) string {
+	candidate := id
+	for i := 2; used[candidate]; i++ {
+		candidate = id + "-" + strconv.Itoa(i)
+	}
+	used[candidate] = true
+	return candidate
+}
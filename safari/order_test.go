@@ -0,0 +1,117 @@
+package safari
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderChapters(t *testing.T) {
+	type expected struct {
+		Filename string
+		Id       string
+		Order    int
+	}
+
+	tests := []struct {
+		name     string
+		urls     []string
+		toc      map[string]TocContent
+		fetched  map[int]Chapter
+		expected []expected
+	}{
+		{
+			name: "all chapters in toc",
+			urls: []string{"u/ch01.html", "u/ch02.html"},
+			toc: map[string]TocContent{
+				"u/ch01.html": {ID: "chap1", Order: 5, Filename: "ch01.html"},
+				"u/ch02.html": {ID: "chap2", Order: 9, Filename: "ch02.html"},
+			},
+			fetched: map[int]Chapter{
+				0: {Filename: "ch01.html"},
+				1: {Filename: "ch02.html"},
+			},
+			expected: []expected{
+				{"ch01.html", "chap1", 1},
+				{"ch02.html", "chap2", 2},
+			},
+		},
+		{
+			name: "chapters missing from toc get unique ids",
+			urls: []string{"u/cover.html", "u/toc01.html", "u/ch01.html"},
+			toc: map[string]TocContent{
+				"u/ch01.html": {ID: "chap1", Filename: "ch01.html"},
+			},
+			fetched: map[int]Chapter{
+				0: {Filename: "cover.html"},
+				1: {Filename: "toc01.html"},
+				2: {Filename: "ch01.html"},
+			},
+			expected: []expected{
+				{"cover.html", "cover.html", 1},
+				{"toc01.html", "toc01.html", 2},
+				{"ch01.html", "chap1", 3},
+			},
+		},
+		{
+			name: "toc matched by filename",
+			urls: []string{"https://host/api/ch01.html"},
+			toc: map[string]TocContent{
+				"https://host/api/other/ch01.html":           {ID: "chap1", Order: 1, Filename: "ch01.html"},
+				"https://host/api/other/ch01.html#section-1": {ID: "sect1", Order: 2, Filename: "ch01.html"},
+			},
+			fetched: map[int]Chapter{
+				0: {Filename: "ch01.html"},
+			},
+			expected: []expected{
+				{"ch01.html", "chap1", 1},
+			},
+		},
+		{
+			name: "gaps in fetched chapters are skipped",
+			urls: []string{"u/a.html", "u/b.html", "u/c.html"},
+			toc:  map[string]TocContent{},
+			fetched: map[int]Chapter{
+				0: {Filename: "a.html"},
+				2: {Filename: "c.html"},
+			},
+			expected: []expected{
+				{"a.html", "a.html", 1},
+				{"c.html", "c.html", 2},
+			},
+		},
+		{
+			name: "duplicate and invalid ids",
+			urls: []string{"u/1.html", "u/2.html", "u/3.html", "u/4.html"},
+			toc: map[string]TocContent{
+				"u/1.html": {ID: "part"},
+				"u/2.html": {ID: "part"},
+				"u/3.html": {ID: "part-2"},
+			},
+			fetched: map[int]Chapter{
+				0: {Filename: "1.html"},
+				1: {Filename: "2.html"},
+				2: {Filename: "3.html"},
+				3: {Filename: "4 final.html"},
+			},
+			expected: []expected{
+				{"1.html", "part", 1},
+				{"2.html", "part-2", 2},
+				{"3.html", "part-2-2", 3},
+				{"4 final.html", "id_4_final.html", 4},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chapters := orderChapters(test.urls, test.toc, test.fetched)
+
+			var result []expected
+			for _, chapter := range chapters {
+				result = append(result, expected{chapter.Filename, chapter.Id, chapter.Order})
+			}
+			assert.Equal(t, test.expected, result)
+		})
+	}
+}
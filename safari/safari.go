@@ -4,14 +4,16 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/kkc/safari-books-downloader/utils"
+
 	logrus "github.com/Sirupsen/logrus"
 )
 
@@ -144,36 +146,54 @@ type Chapter struct {
 	Id             string
 	Order          int
 	StylesheetsURL []string
+	// Unchanged chapters were taken from the snapshot of the last download
+	Unchanged bool
 }
 
+// Book is shared between the fetch goroutines, lock it before touching its fields
 type Book struct {
 	id         string
 	toc        map[string]TocContent
 	chapters   map[int]Chapter
 	stylesheet string
 	meta       Meta
+	excluded   map[string]bool
+	previous   *Snapshot
+	snapshot   *Snapshot
 	sync.RWMutex
 }
 
 type jsonBook struct {
-	Title       string
-	Uuid        string
-	Language    string
-	Author      []string
-	Cover       string
-	Description string
-	Publisher   []string
-	Stylesheet  string
-	Chapters    []Chapter
+	Title        string
+	Uuid         string
+	Language     string
+	Author       []string
+	Cover        string
+	Description  string
+	Publisher    []string
+	Isbn         string
+	Issued       string
+	Updated      time.Time
+	LastModified time.Time
+	Stylesheet   string
+	Chapters     []Chapter
 }
 
 type Safari struct {
 	baseUrl      string
 	clientSecret string
 	clientId     string
-	books        map[string]Book
+	books        *bookStore
 	accessToken  string
-	sync.RWMutex
+	selector     *ChapterSelector
+	concurrency  int
+	retries      int
+	retryBackoff time.Duration
+	client       *http.Client
+	progress     utils.ProgressReporter
+	// markExternalLinks adds class="external" to links leaving the book
+	markExternalLinks bool
+	sync.RWMutex      // guards accessToken
 }
 
 func NewSafari() *Safari {
@@ -182,42 +202,118 @@ func NewSafari() *Safari {
 		baseUrl:      "https://www.safaribooksonline.com",
 		clientSecret: "f52b3e30b68c1820adb08609c799cb6da1c29975",
 		clientId:     "446a8a270214734f42a7",
-		books:        make(map[string]Book),
+		books:        newBookStore(),
+		concurrency:  4,
+		retryBackoff: time.Second,
+		client:       &http.Client{},
+		progress:     utils.NopProgress,
 	}
 
 	return safari
 }
 
+// SelectChapters restricts the chapters fetched by FetchBookById.
+func (s *Safari) SelectChapters(selector *ChapterSelector) {
+	s.selector = selector
+}
+
+// SetProgress sets the reporter receiving the fetch progress
+func (s *Safari) SetProgress(progress utils.ProgressReporter) {
+	s.progress = progress
+}
+
+func (s *Safari) startPhase(phase string, total int) {
+	s.progress.Report(utils.ProgressEvent{Type: utils.PhaseStart, Phase: phase, Total: total})
+}
+
+func (s *Safari) finishPhase(phase string) {
+	s.progress.Report(utils.ProgressEvent{Type: utils.PhaseFinish, Phase: phase})
+}
+
 func prettyprint(b []byte) ([]byte, error) {
 	var out bytes.Buffer
 	err := json.Indent(&out, b, "", "  ")
 	return out.Bytes(), err
 }
 
-func (s *Safari) adjustOrderByChapterNumber(chapters map[int]Chapter) ([]Chapter, error) {
-	total := len(chapters)
-	var chapters_slice []Chapter
-
-	for i := 0; i < total; i++ {
-		chapters_slice = append(chapters_slice, chapters[i])
+// FetchMeta returns the metadata of a book, e.g. to check for updates
+func (s *Safari) FetchMeta(id string, username string, password string) (Meta, error) {
+	err := s.login(username, password)
+	if err != nil {
+		return Meta{}, err
+	}
+	err = s.fetchMeta(id)
+	if err != nil {
+		return Meta{}, err
 	}
 
-	return chapters_slice, nil
+	book, _ := s.books.get(id)
+	book.RLock()
+	defer book.RUnlock()
+	return book.meta, nil
+}
+
+// login unless there already is an access token
+func (s *Safari) login(username string, password string) error {
+	if s.AccessToken() != "" {
+		return nil
+	}
+	s.startPhase("login", 0)
+	err := s.authorizeUser(username, password)
+	if err != nil {
+		return err
+	}
+	s.finishPhase("login")
+	return nil
 }
 
 // Get result by using book id
 func (s *Safari) FetchBookById(id string, username string, password string) ([]byte, error) {
+	data, _, err := s.FetchBookIncremental(id, username, password, nil)
+	return data, err
+}
+
+// FetchBookIncremental fetches a book like FetchBookById, but takes the
+// chapters whose timestamps did not change from the previous snapshot
+// instead of downloading them. It returns the snapshot of this download.
+func (s *Safari) FetchBookIncremental(id string, username string, password string, previous *Snapshot) ([]byte, *Snapshot, error) {
+	data, err := s.fetchBook(id, username, password, previous)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	book, _ := s.books.get(id)
+	book.RLock()
+	defer book.RUnlock()
+	return data, book.snapshot, nil
+}
+
+func (s *Safari) fetchBook(id string, username string, password string, previous *Snapshot) ([]byte, error) {
 	// check input format
 
-	err := s.authorizeUser(username, password)
+	err := s.login(username, password)
 	if err != nil {
 		return nil, err
 	}
+
+	s.startPhase("meta", 0)
 	err = s.fetchMeta(id)
 	if err != nil {
 		return nil, err
 	}
+	if previous != nil {
+		book, _ := s.books.get(id)
+		book.Lock()
+		book.previous = previous
+		book.Unlock()
+	}
 	_ = s.fetchTOC(id)
+	err = s.selectChapters(id)
+	if err != nil {
+		return nil, err
+	}
+	s.finishPhase("meta")
+
 	err = s.fetchChapters(id)
 	if err != nil {
 		return nil, err
@@ -227,31 +323,40 @@ func (s *Safari) FetchBookById(id string, username string, password string) ([]b
 		return nil, err
 	}
 
+	book, _ := s.books.get(id)
+	book.Lock()
+	s.resolveLinks(book)
+	book.Unlock()
+
+	book.RLock()
+	defer book.RUnlock()
+
 	var author []string
-	for _, a := range s.books[id].meta.Authors {
+	for _, a := range book.meta.Authors {
 		author = append(author, a.Name)
 	}
 
 	var publisher []string
-	for _, p := range s.books[id].meta.Publishers {
+	for _, p := range book.meta.Publishers {
 		publisher = append(publisher, p.Name)
 	}
 
-	chapters, err := s.adjustOrderByChapterNumber(s.books[id].chapters)
-	if err != nil {
-		return nil, err
-	}
+	chapters := orderChapters(book.meta.Chapters, book.toc, book.chapters)
 
 	response := &jsonBook{
-		Title:       s.books[id].meta.Title,
-		Uuid:        s.books[id].meta.Identifier,
-		Language:    s.books[id].meta.Language,
-		Author:      author[:],
-		Cover:       s.books[id].meta.Cover,
-		Description: s.books[id].meta.Description,
-		Publisher:   publisher[:],
-		Stylesheet:  s.books[id].stylesheet,
-		Chapters:    chapters,
+		Title:        book.meta.Title,
+		Uuid:         book.meta.Identifier,
+		Language:     book.meta.Language,
+		Author:       author[:],
+		Cover:        book.meta.Cover,
+		Description:  book.meta.Description,
+		Publisher:    publisher[:],
+		Isbn:         book.meta.Isbn,
+		Issued:       book.meta.Issued,
+		Updated:      book.meta.Updated,
+		LastModified: book.meta.LastModifiedTime,
+		Stylesheet:   book.stylesheet,
+		Chapters:     chapters,
 	}
 
 	data, err := json.Marshal(response)
@@ -261,6 +366,37 @@ func (s *Safari) FetchBookById(id string, username string, password string) ([]b
 	return data, nil
 }
 
+// ErrUnauthorized is returned when the server rejects the access token
+var ErrUnauthorized = errors.New("the access token was rejected, please log in again")
+
+// ErrBookNotAvailable is returned when the book does not exist or is not
+// part of the subscription of the user
+var ErrBookNotAvailable = errors.New("the book is not available with this subscription")
+
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return "Error: status code != 200, actual status code '" + e.status + "'"
+}
+
+// AccessToken returns the token of the last login, e.g. to store it
+func (s *Safari) AccessToken() string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.accessToken
+}
+
+// SetAccessToken reuses a stored token instead of logging in again
+func (s *Safari) SetAccessToken(token string) {
+	utils.RegisterSecret(token)
+	s.Lock()
+	s.accessToken = token
+	s.Unlock()
+}
+
 type AuthResponse struct {
 	RefreshToken string `json:"refresh_token"`
 	TokenType    string `json:"token_type"`
@@ -280,7 +416,13 @@ func (s *Safari) authorizeUser(username string, password string) error {
 		"username":      {username},
 		"password":      {password},
 	}
-	resp, err := http.PostForm(uri, form)
+	resp, err := s.do(func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", uri, strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		return req, err
+	})
 	if err != nil {
 		return err
 	}
@@ -302,60 +444,97 @@ func (s *Safari) authorizeUser(username string, password string) error {
 		return err
 	}
 
+	utils.RegisterSecret(stuff.AccessToken)
+	utils.RegisterSecret(stuff.RefreshToken)
+	s.Lock()
 	s.accessToken = stuff.AccessToken
+	s.Unlock()
 	return nil
 }
 
 // Fetch safari resources by given url
 func (s *Safari) fetchResource(url string) (string, error) {
-	uri := s.baseUrl + "/" + url
+	body, err := s.fetchURL(s.baseUrl+"/"+strings.TrimPrefix(url, "/"), true)
+	return string(body), err
+}
 
-	logrus.Info("fetch uri " + uri + " with token " + s.accessToken)
-	req, err := http.NewRequest("GET", uri, nil)
+// FetchAsset downloads a cover, image or stylesheet of a book. Relative
+// urls are resolved against the API and the access token is only sent to
+// the API host.
+func (s *Safari) FetchAsset(assetUrl string) ([]byte, error) {
+	u, err := url.Parse(assetUrl)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if !u.IsAbs() {
+		return s.fetchURL(s.baseUrl+"/"+strings.TrimPrefix(assetUrl, "/"), true)
 	}
-	req.Header.Set("Authorization", "Bearer "+s.accessToken)
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	base, err := url.Parse(s.baseUrl)
+	if err != nil {
+		return nil, err
+	}
+	return s.fetchURL(assetUrl, u.Host == base.Host)
+}
+
+func (s *Safari) fetchURL(uri string, authorize bool) ([]byte, error) {
+	s.RLock()
+	accessToken := s.accessToken
+	s.RUnlock()
+
+	logrus.Debug("fetch uri " + uri)
+	resp, err := s.do(func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", uri, nil)
+		if err == nil && authorize {
+			req.Header.Set("Authorization", "Bearer "+accessToken)
+		}
+		return req, err
+	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, ErrUnauthorized
+	}
 	if resp.StatusCode != 200 {
-		err = errors.New("Error: status code != 200, actual status code '" + resp.Status + "'")
-		return "", err
+		err = &statusError{code: resp.StatusCode, status: resp.Status}
+		return nil, err
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	s.progress.Report(utils.ProgressEvent{Type: utils.BytesDownloaded, Bytes: int64(len(body))})
 
-	return string(body), nil
+	return body, nil
 }
 
 func (s *Safari) fetchMeta(id string) error {
 	url := "api/v1/book/" + id
 	body, err := s.fetchResource(url)
+	if status, ok := err.(*statusError); ok && (status.code == http.StatusForbidden || status.code == http.StatusNotFound) {
+		return ErrBookNotAvailable
+	}
 	if err != nil {
-		fmt.Println(err)
+		logrus.Error(err)
 		return err
 	}
 	var meta Meta
 	err = json.Unmarshal([]byte(body), &meta)
 	if err != nil {
-		fmt.Println(err)
+		logrus.Error(err)
 		return err
 	}
-	s.books[id] = Book{
+	s.books.put(&Book{
 		id:         id,
 		toc:        make(map[string]TocContent),
 		chapters:   make(map[int]Chapter),
 		stylesheet: "",
 		meta:       meta,
-	}
+		snapshot:   newSnapshot(id),
+	})
 	return nil
 }
 
@@ -378,69 +557,98 @@ func (s *Safari) fetchTOC(id string) *map[string]TocContent {
 	url := "api/v1/book/" + id + "/flat-toc/"
 	body, err := s.fetchResource(url)
 	if err != nil {
-		fmt.Println(err)
+		logrus.Error(err)
 		return nil
 	}
 
 	var raw []TocContent
 	err = json.Unmarshal([]byte(body), &raw)
 	if err != nil {
-		fmt.Println(err)
+		logrus.Error(err)
+		return nil
+	}
+
+	book, ok := s.books.get(id)
+	if !ok {
 		return nil
 	}
 
 	toc := make(map[string]TocContent)
+	book.Lock()
 	for _, content := range raw {
-		s.books[id].toc[content.URL] = content
+		book.toc[content.URL] = content
 		toc[content.URL] = content
 	}
+	book.Unlock()
 
 	return &toc
 }
 
 func (s *Safari) fetchChapters(id string) error {
-	// TODO: check if meta exists
-	errChan := make(chan error, 1)
-	resultChan := make(chan struct {
-		int
-		Chapter
-	}, len(s.books[id].meta.Chapters))
-	sem := make(chan int, 1) // four jobs at once
+	book, ok := s.books.get(id)
+	if !ok {
+		return errors.New("book " + id + " has no meta, fetch it first")
+	}
+
+	urls := book.chapterUrls()
+	s.startPhase("chapters", len(urls))
+	errChan := make(chan error, len(urls))
+	sem := make(chan int, s.concurrency) // at most s.concurrency jobs at once
+	var done int32
 	var wg sync.WaitGroup
-	wg.Add(len(s.books[id].meta.Chapters))
-	for index, uri := range s.books[id].meta.Chapters {
-		go s.fetchChapterContent(index, id, uri, sem, &wg, resultChan, errChan)
+	wg.Add(len(urls))
+	for index, uri := range urls {
+		go func(index int, uri string) {
+			defer wg.Done()
+			// failed chapters are not done, the download stops with the error
+			if err := s.fetchChapterContent(index, book, uri, sem); err != nil {
+				errChan <- err
+				return
+			}
+			s.progress.Report(utils.ProgressEvent{
+				Type:    utils.ChapterDone,
+				Current: int(atomic.AddInt32(&done, 1)),
+				Total:   len(urls),
+			})
+		}(index, uri)
 	}
 	wg.Wait()
-	//err := <-errChan
 	close(errChan)
-	close(resultChan)
+	s.finishPhase("chapters")
 
-	book := s.books[id]
-	for r := range resultChan {
-		book.chapters[r.int] = r.Chapter
-	}
-	s.books[id] = book
-	return nil
+	// report the first failure, a closed empty channel yields nil
+	return <-errChan
 }
 
-func (s *Safari) fetchChapterContent(index int, id string, url string, sem chan int, wg *sync.WaitGroup, resultChan chan struct {
-	int
-	Chapter
-}, errChan chan error) {
-	defer wg.Done()
+func (s *Safari) fetchChapterContent(index int, book *Book, url string, sem chan int) error {
 	sem <- 1
+	defer func() { <-sem }()
+
 	uri := strings.Replace(url, s.baseUrl, "", -1)
 	body, err := s.fetchResource(uri)
+	if err != nil {
+		return err
+	}
 	var meta ChapterMeta
 	err = json.Unmarshal([]byte(body), &meta)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
+
+	if previous, ok := book.previousChapter(url); ok && previous.unchangedSince(meta) {
+		logrus.Debug("chapter " + meta.Filename + " is unchanged")
+		chapter := previous.Chapter
+		chapter.Unchanged = true
+		book.setChapter(index, chapter, previous)
+		return nil
+	}
+
 	content_url := meta.Content
 	content_uri := strings.Replace(content_url, s.baseUrl, "", -1)
 	content, err := s.fetchResource(content_uri)
+	if err != nil {
+		return err
+	}
 
 	var chapter Chapter
 	chapter.Filename = meta.Filename
@@ -453,24 +661,51 @@ func (s *Safari) fetchChapterContent(index int, id string, url string, sem chan
 	for _, Stylesheet := range meta.Stylesheets {
 		chapter.StylesheetsURL = append(chapter.StylesheetsURL, Stylesheet.URL)
 	}
-	if chapToc, ok := s.books[id].toc[meta.URL]; ok {
-		chapter.Order = chapToc.Order
-		chapter.Id = chapToc.ID
-	} else {
-		chapter.Order = 0
-		chapter.Id = "tocxhtmlfile"
+	// the snapshot keeps the content as fetched, links are resolved per download
+	snapshot := ChapterSnapshot{
+		Updated:      meta.Updated,
+		LastModified: meta.LastModifiedTime,
+		Chapter:      chapter,
 	}
+	book.setChapter(index, chapter, snapshot)
+	return nil
+}
+
+// Drop the chapters not picked by the selector from the book meta
+func (s *Safari) selectChapters(id string) error {
+	if s.selector == nil {
+		return nil
+	}
+
+	book, ok := s.books.get(id)
+	if !ok {
+		return errors.New("book " + id + " has no meta, fetch it first")
+	}
+
+	book.Lock()
+	defer book.Unlock()
+	selected, excluded := s.selector.filter(book.meta.Chapters, book.toc)
+	if len(selected) == 0 {
+		return errors.New("no chapters matched the selection")
+	}
+	logrus.WithFields(logrus.Fields{
+		"Selected": len(selected),
+		"Total":    len(book.meta.Chapters),
+	}).Info("Select chapters")
 
-	//fmt.Println("fetch:" + id + " url:" + url)
-	resultChan <- struct {
-		int
-		Chapter
-	}{index, chapter}
-	<-sem
+	book.meta.Chapters = selected
+	book.excluded = excluded
+	return nil
 }
 
 func (s *Safari) fetchStylesheet(id string) error {
-	book := s.books[id]
+	book, ok := s.books.get(id)
+	if !ok {
+		return errors.New("book " + id + " has no meta, fetch it first")
+	}
+
+	book.Lock()
+	defer book.Unlock()
 	var stylesheet string
 	for _, chapter := range book.chapters {
 		for _, stylesheetURL := range chapter.StylesheetsURL {
@@ -478,12 +713,11 @@ func (s *Safari) fetchStylesheet(id string) error {
 				stylesheet = stylesheetURL
 			}
 			if stylesheet != stylesheetURL {
-				fmt.Println("an error occurred while fetching stylesheets, there are different stylesheets.")
+				logrus.Warn("an error occurred while fetching stylesheets, there are different stylesheets.")
 			}
 		}
 	}
 	book.stylesheet = stylesheet
-	fmt.Println(book.stylesheet)
-	s.books[id] = book
+	logrus.Debug("stylesheet " + book.stylesheet)
 	return nil
 }
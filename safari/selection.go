@@ -0,0 +1,128 @@
+package safari
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type chapterRange struct {
+	from int
+	to   int
+}
+
+// ChapterSelector filters the chapters of a book before they are fetched.
+// Chapter numbers are 1-based positions in the book's chapter list.
+type ChapterSelector struct {
+	ranges   []chapterRange
+	tocMatch *regexp.Regexp
+}
+
+// NewChapterSelector builds a selector from a range list such as "3-7,12"
+// and a case-insensitive pattern matched against TOC labels. Empty values
+// are ignored; when both are given a chapter has to satisfy both.
+func NewChapterSelector(ranges string, tocMatch string) (*ChapterSelector, error) {
+	selector := &ChapterSelector{}
+
+	if strings.TrimSpace(ranges) != "" {
+		parsed, err := parseChapterRanges(ranges)
+		if err != nil {
+			return nil, err
+		}
+		selector.ranges = parsed
+	}
+
+	if tocMatch != "" {
+		reg, err := regexp.Compile("(?i)" + tocMatch)
+		if err != nil {
+			return nil, fmt.Errorf("invalid toc match %q: %s", tocMatch, err)
+		}
+		selector.tocMatch = reg
+	}
+
+	return selector, nil
+}
+
+func parseChapterRanges(ranges string) ([]chapterRange, error) {
+	var result []chapterRange
+	for _, part := range strings.Split(ranges, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		bounds := strings.SplitN(part, "-", 2)
+		from, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid chapter range %q", part)
+		}
+		to := from
+		if len(bounds) == 2 {
+			to, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid chapter range %q", part)
+			}
+		}
+		if from < 1 || to < from {
+			return nil, fmt.Errorf("invalid chapter range %q", part)
+		}
+		result = append(result, chapterRange{from: from, to: to})
+	}
+
+	if len(result) == 0 {
+		return nil, errors.New("empty chapter range")
+	}
+	return result, nil
+}
+
+// selects reports whether the chapter at the given 1-based position is kept.
+func (c *ChapterSelector) selects(number int, toc TocContent, inToc bool) bool {
+	if c == nil {
+		return true
+	}
+
+	if len(c.ranges) > 0 {
+		inRange := false
+		for _, r := range c.ranges {
+			if number >= r.from && number <= r.to {
+				inRange = true
+				break
+			}
+		}
+		if !inRange {
+			return false
+		}
+	}
+
+	if c.tocMatch != nil {
+		if !inToc || !c.tocMatch.MatchString(toc.Label) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// filter returns the selected chapter urls in their original order together
+// with the filenames of the chapters that were left out.
+func (c *ChapterSelector) filter(chapters []string, toc map[string]TocContent) ([]string, map[string]bool) {
+	var selected []string
+	excluded := make(map[string]bool)
+	for index, uri := range chapters {
+		content, ok := toc[uri]
+		if c.selects(index+1, content, ok) {
+			selected = append(selected, uri)
+			continue
+		}
+
+		filename := path.Base(uri)
+		if ok && content.Filename != "" {
+			filename = content.Filename
+		}
+		excluded[filename] = true
+	}
+	return selected, excluded
+}
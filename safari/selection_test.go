@@ -0,0 +1,37 @@
+package safari
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChapterSelectorRanges(t *testing.T) {
+	selector, err := NewChapterSelector("2-3, 5", "")
+	assert.NoError(t, err)
+
+	chapters := []string{"ch01.html", "ch02.html", "ch03.html", "ch04.html", "ch05.html"}
+	selected, excluded := selector.filter(chapters, map[string]TocContent{})
+	assert.Equal(t, []string{"ch02.html", "ch03.html", "ch05.html"}, selected)
+	assert.Equal(t, map[string]bool{"ch01.html": true, "ch04.html": true}, excluded)
+}
+
+func TestChapterSelectorInvalidRanges(t *testing.T) {
+	for _, ranges := range []string{"0", "a-b", "7-3", ","} {
+		_, err := NewChapterSelector(ranges, "")
+		assert.Error(t, err, ranges)
+	}
+}
+
+func TestChapterSelectorTocMatch(t *testing.T) {
+	selector, err := NewChapterSelector("", "kubernetes")
+	assert.NoError(t, err)
+
+	toc := map[string]TocContent{
+		"ch01.html": {Label: "Introduction", Filename: "ch01.html"},
+		"ch02.html": {Label: "Running Kubernetes", Filename: "ch02.html"},
+	}
+	selected, excluded := selector.filter([]string{"ch01.html", "ch02.html", "ch03.html"}, toc)
+	assert.Equal(t, []string{"ch02.html"}, selected)
+	assert.Len(t, excluded, 2)
+}
@@ -0,0 +1,113 @@
+package safari
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ChapterSnapshot is a fetched chapter with the timestamps it had upstream
+type ChapterSnapshot struct {
+	Updated      time.Time `json:"updated"`
+	LastModified time.Time `json:"last_modified"`
+	Chapter      Chapter   `json:"chapter"`
+}
+
+// unchangedSince reports whether the chapter meta still has the timestamps
+// of the snapshot. Chapters without timestamps always count as changed.
+func (c ChapterSnapshot) unchangedSince(meta ChapterMeta) bool {
+	if meta.Updated.IsZero() && meta.LastModifiedTime.IsZero() {
+		return false
+	}
+	return c.Updated.Equal(meta.Updated) && c.LastModified.Equal(meta.LastModifiedTime)
+}
+
+// Snapshot records every chapter of a download by chapter url, so the next
+// download only needs to fetch the chapters modified since
+type Snapshot struct {
+	BookId   string                     `json:"book_id"`
+	Chapters map[string]ChapterSnapshot `json:"chapters"`
+}
+
+func newSnapshot(id string) *Snapshot {
+	return &Snapshot{
+		BookId:   id,
+		Chapters: make(map[string]ChapterSnapshot),
+	}
+}
+
+// LoadSnapshot reads a snapshot, a missing file returns nil
+func LoadSnapshot(path string) (*Snapshot, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(content, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// Save writes the snapshot to path
+func (s *Snapshot) Save(path string) error {
+	content, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+// Kinds of chapter changes
+const (
+	ChapterAdded    = "added"
+	ChapterModified = "modified"
+	ChapterRemoved  = "removed"
+)
+
+// ChapterChange is one line of the changelog between two snapshots
+type ChapterChange struct {
+	Kind     string
+	Filename string
+	Title    string
+}
+
+// Changes lists the chapters added, modified or removed since previous,
+// sorted by filename
+func (s *Snapshot) Changes(previous *Snapshot) []ChapterChange {
+	var changes []ChapterChange
+	old := make(map[string]ChapterSnapshot)
+	if previous != nil {
+		old = previous.Chapters
+	}
+
+	for url, current := range s.Chapters {
+		before, ok := old[url]
+		switch {
+		case !ok:
+			changes = append(changes, ChapterChange{ChapterAdded, current.Chapter.Filename, current.Chapter.Title})
+		case !before.Updated.Equal(current.Updated) || !before.LastModified.Equal(current.LastModified):
+			changes = append(changes, ChapterChange{ChapterModified, current.Chapter.Filename, current.Chapter.Title})
+		}
+	}
+	for url, before := range old {
+		if _, ok := s.Chapters[url]; !ok {
+			changes = append(changes, ChapterChange{ChapterRemoved, before.Chapter.Filename, before.Chapter.Title})
+		}
+	}
+
+	sort.Slice(changes, func(a, b int) bool {
+		return changes[a].Filename < changes[b].Filename
+	})
+	return changes
+}
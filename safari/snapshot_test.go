@@ -0,0 +1,88 @@
+package safari
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchBookIncrementalReusesUnchangedChapters(t *testing.T) {
+	s, server := newFakeSafari(t, 3)
+	defer server.Close()
+
+	_, previous, err := s.FetchBookIncremental("1", "user", "password", nil)
+	assert.NoError(t, err)
+	if !assert.Len(t, previous.Chapters, 3) {
+		return
+	}
+
+	// mark the cached chapters so reuse is visible, and age the second one
+	var modified string
+	for url, chapter := range previous.Chapters {
+		chapter.Chapter.Content = "cached"
+		if chapter.Chapter.Filename == "ch001.html" {
+			chapter.Updated = chapterUpdated.Add(-time.Hour)
+			modified = url
+		}
+		previous.Chapters[url] = chapter
+	}
+
+	data, snapshot, err := s.FetchBookIncremental("1", "user", "password", previous)
+	assert.NoError(t, err)
+
+	var book jsonBook
+	assert.NoError(t, json.Unmarshal(data, &book))
+	if assert.Len(t, book.Chapters, 3) {
+		assert.Equal(t, "cached", book.Chapters[0].Content)
+		assert.True(t, book.Chapters[0].Unchanged)
+		assert.Equal(t, "<p>ch001.html of 1</p>", book.Chapters[1].Content)
+		assert.False(t, book.Chapters[1].Unchanged)
+		assert.Equal(t, "cached", book.Chapters[2].Content)
+	}
+	assert.True(t, chapterUpdated.Equal(snapshot.Chapters[modified].Updated))
+	assert.Equal(t, []ChapterChange{{ChapterModified, "ch001.html", "Title ch001.html"}}, snapshot.Changes(previous))
+}
+
+func TestSnapshotChanges(t *testing.T) {
+	updated := time.Date(2018, 4, 12, 0, 0, 0, 0, time.UTC)
+	previous := newSnapshot("1")
+	previous.Chapters["a"] = ChapterSnapshot{Updated: updated, Chapter: Chapter{Filename: "a.html"}}
+	previous.Chapters["b"] = ChapterSnapshot{Updated: updated, Chapter: Chapter{Filename: "b.html"}}
+	previous.Chapters["c"] = ChapterSnapshot{Updated: updated, Chapter: Chapter{Filename: "c.html"}}
+
+	current := newSnapshot("1")
+	current.Chapters["a"] = previous.Chapters["a"]
+	current.Chapters["b"] = ChapterSnapshot{Updated: updated.Add(time.Hour), Chapter: Chapter{Filename: "b.html"}}
+	current.Chapters["d"] = ChapterSnapshot{Updated: updated, Chapter: Chapter{Filename: "d.html"}}
+
+	assert.Equal(t, []ChapterChange{
+		{ChapterModified, "b.html", ""},
+		{ChapterRemoved, "c.html", ""},
+		{ChapterAdded, "d.html", ""},
+	}, current.Changes(previous))
+	assert.Len(t, current.Changes(nil), 3)
+}
+
+func TestSnapshotSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cache", "1.snapshot.json")
+	snapshot, err := LoadSnapshot(path)
+	assert.NoError(t, err)
+	assert.Nil(t, snapshot)
+
+	saved := newSnapshot("1")
+	saved.Chapters["a"] = ChapterSnapshot{Chapter: Chapter{Filename: "a.html", Content: "<p>a</p>"}}
+	assert.NoError(t, saved.Save(path))
+
+	snapshot, err = LoadSnapshot(path)
+	assert.NoError(t, err)
+	assert.Equal(t, saved, snapshot)
+}
@@ -0,0 +1,58 @@
+package safari
+
+import "sync"
+
+// bookStore keeps the books fetched by a Safari instance. It is safe for
+// concurrent use; every Book carries its own lock for its fields.
+type bookStore struct {
+	sync.RWMutex
+	books map[string]*Book
+}
+
+func newBookStore() *bookStore {
+	return &bookStore{
+		books: make(map[string]*Book),
+	}
+}
+
+func (b *bookStore) get(id string) (*Book, bool) {
+	b.RLock()
+	defer b.RUnlock()
+	book, ok := b.books[id]
+	return book, ok
+}
+
+func (b *bookStore) put(book *Book) {
+	b.Lock()
+	defer b.Unlock()
+	b.books[book.id] = book
+}
+
+// chapterUrls returns a copy of the chapter urls to fetch
+func (b *Book) chapterUrls() []string {
+	b.RLock()
+	defer b.RUnlock()
+	return append([]string(nil), b.meta.Chapters...)
+}
+
+// previousChapter looks up a chapter url in the snapshot of the last
+// download, the snapshot is never modified while fetching
+func (b *Book) previousChapter(url string) (ChapterSnapshot, bool) {
+	b.RLock()
+	previous := b.previous
+	b.RUnlock()
+
+	if previous == nil {
+		return ChapterSnapshot{}, false
+	}
+	chapter, ok := previous.Chapters[url]
+	return chapter, ok
+}
+
+// setChapter stores a fetched chapter and records it in the new snapshot
+func (b *Book) setChapter(index int, chapter Chapter, snapshot ChapterSnapshot) {
+	b.Lock()
+	defer b.Unlock()
+	b.chapters[index] = chapter
+	b.snapshot.Chapters[b.meta.Chapters[index]] = snapshot
+}
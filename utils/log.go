@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	logrus "github.com/Sirupsen/logrus"
+)
+
+const redacted = "[REDACTED]"
+
+var secrets = struct {
+	sync.RWMutex
+	values []string
+}{}
+
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(bearer\s+)[^\s"',]+`),
+	regexp.MustCompile(`(?i)((?:access_token|refresh_token|token|password|client_secret)\s*[=:]\s*"?)[^\s"&,]+`),
+	regexp.MustCompile(`(?i)("(?:access_token|refresh_token|token|password|client_secret)"\s*:\s*")[^"]*`),
+}
+
+var secretFieldReg = regexp.MustCompile(`(?i)token|password|secret|authorization`)
+
+// RegisterSecret makes sure the given value never shows up in the logs
+func RegisterSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	secrets.values = append(secrets.values, secret)
+}
+
+// Redact removes registered secrets, bearer tokens and passwords from s
+func Redact(s string) string {
+	secrets.RLock()
+	for _, secret := range secrets.values {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	secrets.RUnlock()
+
+	for _, reg := range secretPatterns {
+		s = reg.ReplaceAllString(s, "${1}"+redacted)
+	}
+	return s
+}
+
+// redactingFormatter scrubs every entry before handing it to the real formatter
+type redactingFormatter struct {
+	formatter logrus.Formatter
+}
+
+func (f *redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	entry.Message = Redact(entry.Message)
+
+	data := make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		if secretFieldReg.MatchString(key) {
+			data[key] = redacted
+			continue
+		}
+		data[key] = redactValue(value)
+	}
+	entry.Data = data
+
+	return f.formatter.Format(entry)
+}
+
+// redactValue redacts strings and the text of errors, stringers and other
+// values, values without secrets keep their type
+func redactValue(value interface{}) interface{} {
+	if s, ok := value.(string); ok {
+		return Redact(s)
+	}
+	if value == nil {
+		return value
+	}
+	s := fmt.Sprint(value)
+	if r := Redact(s); r != s {
+		return r
+	}
+	return value
+}
+
+// ConfigureLogging sets level and format of the standard logger. quiet only
+// keeps errors and verbose turns on debug output, both override level.
+func ConfigureLogging(level string, format string, quiet bool, verbose bool) error {
+	if quiet && verbose {
+		return fmt.Errorf("--quiet and --verbose can not be used together")
+	}
+
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	if quiet {
+		lvl = logrus.ErrorLevel
+	}
+	if verbose {
+		lvl = logrus.DebugLevel
+	}
+	logrus.SetLevel(lvl)
+
+	var formatter logrus.Formatter
+	switch format {
+	case "", "text":
+		formatter = &logrus.TextFormatter{}
+	case "json":
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("invalid log format %q, expected text or json", format)
+	}
+	logrus.SetFormatter(&redactingFormatter{formatter: formatter})
+	return nil
+}
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	logrus "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedact(t *testing.T) {
+	RegisterSecret("hunter2")
+
+	tests := map[string]string{
+		"Authorization: Bearer abc.def":              "Authorization: Bearer [REDACTED]",
+		"login with password hunter2":                "login with password [REDACTED]",
+		"access_token=abc&scope=x":                   "access_token=[REDACTED]&scope=x",
+		`{"access_token": "abc", "expires_in": 10}`:  `{"access_token": "[REDACTED]", "expires_in": 10}`,
+		"fetch uri https://host/api/v1/book/1234567": "fetch uri https://host/api/v1/book/1234567",
+	}
+	for input, expected := range tests {
+		assert.Equal(t, expected, Redact(input))
+	}
+}
+
+func TestRedactingFormatter(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &out
+	logger.Formatter = &redactingFormatter{formatter: &logrus.JSONFormatter{}}
+
+	logger.WithFields(logrus.Fields{
+		"Token": "abc",
+		"User":  "kkc",
+	}).Info("header Bearer abc")
+
+	assert.NotContains(t, out.String(), "abc")
+	assert.Contains(t, out.String(), "kkc")
+}
+
+type stringer string
+
+func (s stringer) String() string { return string(s) }
+
+func TestRedactingFormatterRedactsErrors(t *testing.T) {
+	RegisterSecret("s3cr3t-token")
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &out
+	logger.Formatter = &redactingFormatter{formatter: &logrus.TextFormatter{DisableColors: true}}
+
+	logger.WithError(errors.New("Get https://host/api?key=s3cr3t-token: timeout")).WithFields(logrus.Fields{
+		"Url":    stringer("https://host/?s3cr3t-token"),
+		"Values": []string{"s3cr3t-token"},
+		"Count":  3,
+	}).Warn("fetch failed")
+
+	assert.NotContains(t, out.String(), "s3cr3t-token")
+	assert.Contains(t, out.String(), "timeout")
+	assert.Contains(t, out.String(), "Count=3")
+}
+
+func TestConfigureLogging(t *testing.T) {
+	defer logrus.SetLevel(logrus.InfoLevel)
+
+	assert.NoError(t, ConfigureLogging("warn", "json", false, false))
+	assert.Equal(t, logrus.WarnLevel, logrus.GetLevel())
+
+	assert.NoError(t, ConfigureLogging("info", "text", true, false))
+	assert.Equal(t, logrus.ErrorLevel, logrus.GetLevel())
+
+	assert.NoError(t, ConfigureLogging("info", "text", false, true))
+	assert.Equal(t, logrus.DebugLevel, logrus.GetLevel())
+
+	assert.Error(t, ConfigureLogging("loud", "text", false, false))
+	assert.Error(t, ConfigureLogging("info", "xml", false, false))
+	assert.Error(t, ConfigureLogging("info", "text", true, true))
+}
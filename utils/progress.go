@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Progress event types
+const (
+	PhaseStart      = "phase_start"
+	PhaseFinish     = "phase_finish"
+	ChapterDone     = "chapter"
+	ImageDone       = "image"
+	BytesDownloaded = "bytes"
+)
+
+// ProgressEvent describes one step of a download
+type ProgressEvent struct {
+	Type    string    `json:"type"`
+	Phase   string    `json:"phase,omitempty"`
+	Current int       `json:"current,omitempty"`
+	Total   int       `json:"total,omitempty"`
+	Bytes   int64     `json:"bytes,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// ProgressReporter receives the progress events emitted by the safari and
+// ebook packages. Implementations must be safe for concurrent use.
+type ProgressReporter interface {
+	Report(event ProgressEvent)
+}
+
+type nopProgress struct{}
+
+func (nopProgress) Report(event ProgressEvent) {}
+
+// NopProgress drops every event
+var NopProgress ProgressReporter = nopProgress{}
+
+// NewProgress returns the reporter for the given mode: "json", "bar", "none"
+// or "auto", which draws a bar only when stderr is a terminal.
+func NewProgress(mode string) (ProgressReporter, error) {
+	return newProgress(mode, os.Stdout, os.Stderr)
+}
+
+// newProgress writes the JSON events to stdout and the bar to stderr
+func newProgress(mode string, stdout io.Writer, stderr io.Writer) (ProgressReporter, error) {
+	switch mode {
+	case "json":
+		return NewJSONProgress(stdout), nil
+	case "bar":
+		return NewBarProgress(stderr), nil
+	case "none":
+		return NopProgress, nil
+	case "", "auto":
+		if f, ok := stderr.(*os.File); ok && IsTerminal(f) {
+			return NewBarProgress(stderr), nil
+		}
+		return NopProgress, nil
+	}
+	return nil, fmt.Errorf("invalid progress mode %q, expected auto, bar, json or none", mode)
+}
+
+// IsTerminal reports whether f is attached to a terminal
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+type jsonProgress struct {
+	sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewJSONProgress writes every event as one line of JSON
+func NewJSONProgress(w io.Writer) ProgressReporter {
+	return &jsonProgress{encoder: json.NewEncoder(w)}
+}
+
+func (p *jsonProgress) Report(event ProgressEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.encoder.Encode(event)
+}
+
+type barProgress struct {
+	sync.Mutex
+	w       io.Writer
+	phase   string
+	current int
+	total   int
+	bytes   int64
+}
+
+const barWidth = 30
+
+// NewBarProgress redraws a single progress bar line on w
+func NewBarProgress(w io.Writer) ProgressReporter {
+	return &barProgress{w: w}
+}
+
+func (p *barProgress) Report(event ProgressEvent) {
+	p.Lock()
+	defer p.Unlock()
+
+	switch event.Type {
+	case PhaseStart:
+		p.phase = event.Phase
+		p.current = 0
+		p.total = event.Total
+	case PhaseFinish:
+		if event.Phase == p.phase && p.total > 0 {
+			p.current = p.total
+		}
+		p.draw()
+		fmt.Fprintln(p.w)
+		return
+	case ChapterDone, ImageDone:
+		p.current = event.Current
+		if event.Total > 0 {
+			p.total = event.Total
+		}
+	case BytesDownloaded:
+		p.bytes += event.Bytes
+	}
+	p.draw()
+}
+
+func (p *barProgress) draw() {
+	filled := 0
+	if p.total > 0 {
+		filled = barWidth * p.current / p.total
+	}
+	if filled > barWidth {
+		filled = barWidth
+	}
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", barWidth-filled)
+	fmt.Fprintf(p.w, "\r%-10s [%s] %d/%d %s", p.phase, bar, p.current, p.total, formatBytes(p.bytes))
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
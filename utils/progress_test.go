@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// reportDownload sends the events of a small download
+func reportDownload(p ProgressReporter) {
+	at := time.Date(2018, 4, 12, 0, 0, 0, 0, time.UTC)
+	p.Report(ProgressEvent{Type: PhaseStart, Phase: "chapters", Total: 4, Time: at})
+	p.Report(ProgressEvent{Type: ChapterDone, Current: 1, Total: 4, Time: at})
+	p.Report(ProgressEvent{Type: BytesDownloaded, Bytes: 2048, Time: at})
+	p.Report(ProgressEvent{Type: ChapterDone, Current: 2, Total: 4, Time: at})
+	p.Report(ProgressEvent{Type: PhaseFinish, Phase: "chapters", Time: at})
+}
+
+func TestJSONProgress(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	p, err := newProgress("json", &stdout, &stderr)
+	assert.NoError(t, err)
+	reportDownload(p)
+	out := stdout.String()
+
+	var types []string
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		var event ProgressEvent
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []string{PhaseStart, ChapterDone, BytesDownloaded, ChapterDone, PhaseFinish}, types)
+	assert.True(t, strings.HasPrefix(out, `{"type":"phase_start","phase":"chapters","total":4,"time":"2018-04-12T00:00:00Z"}`+"\n"))
+	assert.Empty(t, stderr.String())
+}
+
+func TestBarProgress(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	p, err := newProgress("bar", &stdout, &stderr)
+	assert.NoError(t, err)
+	reportDownload(p)
+
+	assert.Empty(t, stdout.String())
+	assert.True(t, strings.HasSuffix(stderr.String(), "\n"))
+	lines := strings.Split(strings.TrimSuffix(stderr.String(), "\n"), "\r")
+	assert.Equal(t, "chapters   [==============================] 4/4 2.0 KB", lines[len(lines)-1])
+	assert.Contains(t, lines, "chapters   [===============               ] 2/4 2.0 KB")
+}
+
+func TestNewProgressModes(t *testing.T) {
+	var buffer bytes.Buffer
+	p, err := newProgress("auto", &buffer, &buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, NopProgress, p)
+	_, err = newProgress("fancy", &buffer, &buffer)
+	assert.Error(t, err)
+}